@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// jobStatus is the JSON representation of a download job in the REST API.
+type jobStatus struct {
+	ID          string          `json:"id"`                    // The ID of the job.
+	State       jobState        `json:"state"`                 // The state of the job.
+	Error       string          `json:"error,omitempty"`       // Why the job failed.
+	Request     DownloadRequest `json:"request"`               // The area, zoom levels, map source and options.
+	World       bool            `json:"world"`                 // Whether the job downloads the world basemap.
+	TotalTiles  int             `json:"total_tiles"`           // The number of tiles of the job.
+	Processed   int             `json:"processed"`             // The number of processed tiles.
+	Downloaded  int             `json:"downloaded"`            // The number of downloaded tiles.
+	Skipped     int             `json:"skipped"`               // The number of tiles that already existed.
+	Missing     int             `json:"missing"`               // The number of tiles that the map source does not have.
+	Failed      int             `json:"failed"`                // The number of tiles that failed to download.
+	FailedTiles []string        `json:"failed_tiles"`          // The tiles (z/x/y) that failed to download.
+	QueuedAt    time.Time       `json:"queued_at"`             // The time the job was queued.
+	StartedAt   *time.Time      `json:"started_at,omitempty"`  // The time the job was started.
+	FinishedAt  *time.Time      `json:"finished_at,omitempty"` // The time the job finished.
+}
+
+// apiJobRequest is the body of a request to create a download job.
+type apiJobRequest struct {
+	DownloadRequest
+	World bool `json:"world"` // Download the world basemap instead of the polygons.
+}
+
+// status returns the current status of the job.
+func (j *downloadJob) status() jobStatus {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	m := j.manifest
+	if j.progress != nil {
+		m = j.progress.snapshot()
+	}
+	s := jobStatus{
+		ID:          j.ID,
+		State:       j.state,
+		Error:       j.err,
+		Request:     m.Request,
+		World:       m.World,
+		TotalTiles:  m.TotalTiles,
+		Downloaded:  m.Downloaded,
+		Skipped:     m.Skipped,
+		Missing:     m.Missing,
+		Failed:      len(m.FailedTiles),
+		FailedTiles: m.FailedTiles,
+		QueuedAt:    j.queuedAt,
+	}
+	if s.FailedTiles == nil {
+		s.FailedTiles = []string{}
+	}
+	s.Processed = s.Downloaded + s.Skipped + s.Missing + s.Failed
+	if !j.startedAt.IsZero() {
+		startedAt := j.startedAt
+		s.StartedAt = &startedAt
+	}
+	if !j.finishedAt.IsZero() {
+		finishedAt := j.finishedAt
+		s.FinishedAt = &finishedAt
+	}
+	return s
+}
+
+// apiCreateJob queues a new download job.
+func apiCreateJob(w http.ResponseWriter, r *http.Request) {
+	var req apiJobRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid download request")
+		return
+	}
+
+	mapStyle, err := resolveMapSource(req.MapStyle)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	req.MapStyle = mapStyle
+
+	var m jobManifest
+	if req.World {
+		if err := validateRefresh(req.Refresh, req.RefreshDays); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		m = newJobManifest(DownloadRequest{
+			MapStyle:      req.MapStyle,
+			ConvertTo8Bit: req.ConvertTo8Bit,
+			Refresh:       req.Refresh,
+			RefreshDays:   req.RefreshDays,
+		}, true)
+	} else {
+		if err := validateDownloadRequest(req.DownloadRequest); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		m = newJobManifest(req.DownloadRequest, false)
+	}
+	submitAPIJob(w, m)
+}
+
+// apiResumeJob queues an unfinished download job that was cancelled or interrupted by a restart.
+func apiResumeJob(w http.ResponseWriter, r *http.Request) {
+	m, err := loadJobManifest(r.PathValue("id"))
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	submitAPIJob(w, m)
+}
+
+// submitAPIJob queues a job and writes its status.
+func submitAPIJob(w http.ResponseWriter, m jobManifest) {
+	job, _, err := downloadJobs.submit(m, nil, nil)
+	if err != nil {
+		writeJSONError(w, http.StatusConflict, err.Error())
+		return
+	}
+	w.Header().Set("Location", "/api/jobs/"+job.ID)
+	writeJSON(w, http.StatusAccepted, job.status())
+}
+
+// apiListJobs lists all known download jobs.
+func apiListJobs(w http.ResponseWriter, r *http.Request) {
+	jobs := downloadJobs.list()
+	statuses := make([]jobStatus, 0, len(jobs))
+	for _, job := range jobs {
+		statuses = append(statuses, job.status())
+	}
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+// apiGetJob returns the status of a download job.
+func apiGetJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := downloadJobs.get(r.PathValue("id"))
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, errJobNotFound.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, job.status())
+}
+
+// apiCancelJob cancels a queued or running download job.
+func apiCancelJob(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if err := downloadJobs.cancel(id); err != nil {
+		status := http.StatusConflict
+		if errors.Is(err, errJobNotFound) {
+			status = http.StatusNotFound
+		}
+		writeJSONError(w, status, err.Error())
+		return
+	}
+	job, _ := downloadJobs.get(id)
+	writeJSON(w, http.StatusOK, job.status())
+}
+
+// apiSource is a map source in the REST API.
+type apiSource struct {
+	Name string `json:"name"` // The name of the map source.
+	MapSource
+}
+
+// apiCreateSource adds a map source to the user sources file of the maps directory.
+func apiCreateSource(w http.ResponseWriter, r *http.Request) {
+	var source apiSource
+	if err := json.NewDecoder(r.Body).Decode(&source); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid map source")
+		return
+	}
+	writeSourceResult(w, http.StatusCreated, source, putUserSource(source.Name, source.MapSource, false))
+}
+
+// apiUpdateSource adds or replaces a map source in the user sources file of the maps directory.
+func apiUpdateSource(w http.ResponseWriter, r *http.Request) {
+	var source apiSource
+	if err := json.NewDecoder(r.Body).Decode(&source); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid map source")
+		return
+	}
+	source.Name = r.PathValue("name")
+	writeSourceResult(w, http.StatusOK, source, putUserSource(source.Name, source.MapSource, true))
+}
+
+// apiDeleteSource removes a map source from the user sources file of the maps directory.
+// The downloaded tiles of the map source are kept.
+func apiDeleteSource(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if err := deleteUserSource(name); err != nil {
+		writeSourceResult(w, 0, apiSource{}, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeSourceResult writes the changed map source or the error of a change.
+func writeSourceResult(w http.ResponseWriter, status int, source apiSource, err error) {
+	switch {
+	case errors.Is(err, errSourceExists):
+		writeJSONError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, errSourceNotFound):
+		writeJSONError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, errInvalidSource):
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+	case err != nil:
+		log.Printf("Could not change map sources: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+	default:
+		writeJSON(w, status, source)
+	}
+}
+
+// sameOrigin wraps the handler of a request that changes data, so that other web pages cannot send it from the user's browser.
+// Browsers send cross-site form and text/plain requests without asking first, so the Origin must match the host,
+// and a request body must be JSON, which browsers never send to another origin without the server's permission.
+func sameOrigin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if origin := r.Header.Get("Origin"); origin != "" {
+			u, err := url.Parse(origin)
+			if err != nil || u.Host != r.Host {
+				writeJSONError(w, http.StatusForbidden, "Requests from other origins are not allowed")
+				return
+			}
+		}
+		if r.ContentLength != 0 {
+			mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if err != nil || mediaType != "application/json" {
+				writeJSONError(w, http.StatusUnsupportedMediaType, "Content-Type must be application/json")
+				return
+			}
+		}
+		handler(w, r)
+	}
+}
+
+// writeJSON writes a value as JSON response.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		log.Printf("Could not write response: %v", err)
+	}
+}
+
+// writeJSONError writes an error message as JSON response.
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// auditReport is the result of checking the cached tiles of a map style.
+type auditReport struct {
+	Style   string       `json:"style"`            // The name of the map style.
+	Checked int          `json:"checked"`          // The number of checked tiles.
+	Zooms   []*auditZoom `json:"zooms"`            // The checked tiles and problems per zoom level.
+	Tiles   []auditTile  `json:"tiles"`            // The tiles with problems.
+	Deleted int          `json:"deleted"`          // The number of deleted tiles.
+	JobID   string       `json:"job_id,omitempty"` // The download job that downloads the deleted tiles again.
+}
+
+// auditZoom counts the checked tiles and problems of a zoom level.
+type auditZoom struct {
+	Zoom     uint32         `json:"zoom"`     // The zoom level.
+	Tiles    int            `json:"tiles"`    // The number of checked tiles.
+	Problems map[string]int `json:"problems"` // The number of tiles by kind of problem.
+}
+
+// auditTile is a cached tile with a problem.
+type auditTile struct {
+	Tile   string `json:"tile"`   // The tile (z/x/y).
+	Kind   string `json:"kind"`   // The kind of the problem.
+	Detail string `json:"detail"` // A description of the problem.
+}
+
+// auditTiles checks every cached tile of a map style. Images must have the tile size of the map source, if it is known.
+func auditTiles(styleName string) (*auditReport, error) {
+	store, err := getTileStore(styleName, false)
+	if err != nil {
+		return nil, err
+	}
+	tileSize := 0
+	if source, ok := lookupMapSource(styleName); ok {
+		tileSize = source.TileSize
+	}
+
+	report := &auditReport{Style: styleName, Zooms: []*auditZoom{}, Tiles: []auditTile{}}
+	zooms := map[uint32]*auditZoom{}
+	err = store.Walk(func(tile Tile) error {
+		data, format, err := store.Get(tile)
+		if err != nil {
+			return err
+		}
+		zoom, ok := zooms[tile.Z]
+		if !ok {
+			zoom = &auditZoom{Zoom: tile.Z, Problems: map[string]int{}}
+			zooms[tile.Z] = zoom
+			report.Zooms = append(report.Zooms, zoom)
+		}
+		zoom.Tiles++
+		report.Checked++
+
+		var problem *tileProblem
+		if errors.As(checkTile(data, format, tileSize), &problem) {
+			zoom.Problems[problem.Kind]++
+			report.Tiles = append(report.Tiles, auditTile{Tile: tileKey(tile), Kind: problem.Kind, Detail: problem.Detail})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not read cache: %w", err)
+	}
+	sort.Slice(report.Zooms, func(i, j int) bool { return report.Zooms[i].Zoom < report.Zooms[j].Zoom })
+	return report, nil
+}
+
+// deleteTiles deletes the tiles with problems from the cache of the map style.
+func (r *auditReport) deleteTiles() error {
+	store, err := getTileStore(r.Style, false)
+	if err != nil {
+		return err
+	}
+	for _, t := range r.Tiles {
+		tile, err := parseTileKey(t.Tile)
+		if err != nil {
+			return err
+		}
+		if err := store.Delete(tile); err != nil {
+			return fmt.Errorf("could not delete tile %s: %w", t.Tile, err)
+		}
+		r.Deleted++
+	}
+	return store.Sync()
+}
+
+// requeueManifest returns a download job that downloads the tiles with problems again.
+func (r *auditReport) requeueManifest() (jobManifest, error) {
+	source, ok := lookupMapSource(r.Style)
+	if !ok {
+		return jobManifest{}, fmt.Errorf("map style %s is not a configured map source, so its tiles cannot be downloaded again", r.Style)
+	}
+	m := newJobManifest(DownloadRequest{MapStyle: source.URL}, false)
+	for _, t := range r.Tiles {
+		m.Tiles = append(m.Tiles, t.Tile)
+	}
+	m.TotalTiles = len(m.Tiles)
+	return m, nil
+}
+
+// runAuditCommand checks the cached tiles of a map style and returns the exit code.
+// The exit code is 1 if tiles with problems were found and not deleted.
+func runAuditCommand(args []string) int {
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+	registerCacheDirFlag(fs)
+	registerSourcesFlag(fs)
+	source := fs.String("source", "OSM", "Name of the map source to check")
+	list := fs.Bool("list", false, "List every tile with a problem")
+	deleteTiles := fs.Bool("delete", false, "Delete the tiles with problems")
+	requeue := fs.Bool("requeue", false, "Delete the tiles with problems and create a download job for them")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s audit [options]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if err := loadMapSources(); err != nil {
+		log.Printf("Failed to load map sources: %v", err)
+		return 1
+	}
+	defer closeTileStores()
+
+	report, err := auditTiles(*source)
+	if err != nil {
+		log.Printf("Failed to check map style: %v", err)
+		return 1
+	}
+	printAuditReport(report, *list)
+	if len(report.Tiles) == 0 {
+		return 0
+	}
+	if !*deleteTiles && !*requeue {
+		return 1
+	}
+
+	var m jobManifest
+	if *requeue {
+		// Check the map source before deleting tiles that could not be downloaded again.
+		if m, err = report.requeueManifest(); err != nil {
+			log.Print(err)
+			return 1
+		}
+	}
+	if err := report.deleteTiles(); err != nil {
+		log.Printf("Failed to delete tiles: %v", err)
+		return 1
+	}
+	fmt.Printf("Deleted %d tiles\n", report.Deleted)
+	if *requeue {
+		saveJobManifest(m)
+		fmt.Printf("Created download job %s, start it with: %s download -resume %s\n", m.ID, os.Args[0], m.ID)
+	}
+	return 0
+}
+
+// printAuditReport prints the number of checked tiles and problems per zoom level.
+func printAuditReport(report *auditReport, list bool) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(w, "Zoom\tTiles\t%s\t\n", strings.Join(tileProblems, "\t"))
+	totals := map[string]int{}
+	for _, zoom := range report.Zooms {
+		fmt.Fprintf(w, "%d\t%d\t", zoom.Zoom, zoom.Tiles)
+		for _, kind := range tileProblems {
+			fmt.Fprintf(w, "%d\t", zoom.Problems[kind])
+			totals[kind] += zoom.Problems[kind]
+		}
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintf(w, "Total\t%d\t", report.Checked)
+	for _, kind := range tileProblems {
+		fmt.Fprintf(w, "%d\t", totals[kind])
+	}
+	fmt.Fprintln(w)
+	if err := w.Flush(); err != nil {
+		log.Printf("Could not print report: %v", err)
+	}
+
+	if list {
+		for _, t := range report.Tiles {
+			fmt.Printf("%s: %s\n", t.Tile, t.Detail)
+		}
+	}
+	fmt.Printf("%d of %d tiles have problems\n", len(report.Tiles), report.Checked)
+}
+
+// apiAudit checks the cached tiles of a map style and optionally deletes and downloads the tiles with problems again.
+func apiAudit(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Style   string `json:"style"`   // The name of the map style.
+		Delete  bool   `json:"delete"`  // Delete the tiles with problems.
+		Requeue bool   `json:"requeue"` // Delete the tiles with problems and queue a download job for them.
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Style == "" {
+		writeJSONError(w, http.StatusBadRequest, "Invalid audit request")
+		return
+	}
+
+	report, err := auditTiles(req.Style)
+	if errors.Is(err, fs.ErrNotExist) {
+		writeJSONError(w, http.StatusNotFound, fmt.Sprintf("No cached tiles for map style %s", req.Style))
+		return
+	}
+	if err != nil {
+		log.Printf("Could not check map style %s: %v", req.Style, err)
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if len(report.Tiles) == 0 || (!req.Delete && !req.Requeue) {
+		writeJSON(w, http.StatusOK, report)
+		return
+	}
+
+	var m jobManifest
+	if req.Requeue {
+		if m, err = report.requeueManifest(); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	if err := report.deleteTiles(); err != nil {
+		log.Printf("Could not delete tiles of map style %s: %v", req.Style, err)
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if req.Requeue {
+		job, _, err := downloadJobs.submit(m, nil, nil)
+		if err != nil {
+			// Keep the job, so it can be resumed later.
+			saveJobManifest(m)
+			writeJSONError(w, http.StatusConflict, err.Error())
+			return
+		}
+		report.JobID = job.ID
+	}
+	writeJSON(w, http.StatusOK, report)
+}
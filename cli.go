@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// runDownloadCommand downloads tiles without starting the web interface and returns the exit code.
+func runDownloadCommand(args []string) int {
+	fs := flag.NewFlagSet("download", flag.ExitOnError)
+	registerDownloadFlags(fs)
+	bbox := fs.String("bbox", "", "Bounding box to download as W,S,E,N (e.g. 9.7,53.4,10.3,53.7)")
+	polygonFile := fs.String("polygon", "", "GeoJSON file with the polygons to download")
+	minZoom := fs.Int("min-zoom", 0, "Minimum zoom level to download")
+	maxZoom := fs.Int("max-zoom", 10, "Maximum zoom level to download")
+	source := fs.String("source", "OSM", "Name of the map source or a tile URL template")
+	convertTo8Bit := fs.Bool("8bit", false, "Convert tiles to 8-bit PNG")
+	refresh := fs.String("refresh", refreshSkip, "How existing tiles are refreshed: skip, overwrite, older (than -refresh-days) or expired (per Cache-Control/Expires)")
+	refreshDays := fs.Int("refresh-days", 30, "Age in days after which tiles are refreshed with -refresh older")
+	resume := fs.String("resume", "", "ID of an unfinished download job to resume instead of starting a new one")
+	listJobs := fs.Bool("list-jobs", false, "List the unfinished download jobs and exit")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s download [options]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if err := validateDownloadFlags(); err != nil {
+		log.Print(err)
+		return 2
+	}
+	if err := loadMapSources(); err != nil {
+		log.Printf("Failed to load map sources: %v", err)
+		return 1
+	}
+
+	if *listJobs {
+		manifests, err := loadJobManifests()
+		if err != nil {
+			log.Printf("Failed to load unfinished download jobs: %v", err)
+			return 1
+		}
+		for _, m := range manifests {
+			fmt.Printf("%s  %s  %s\n", m.ID, m.UpdatedAt.Format(time.DateTime), m.describe())
+		}
+		return 0
+	}
+
+	var m jobManifest
+	if *resume != "" {
+		var err error
+		if m, err = loadJobManifest(*resume); err != nil {
+			log.Print(err)
+			return 2
+		}
+	} else {
+		mapStyle, err := resolveMapSource(*source)
+		if err != nil {
+			log.Print(err)
+			return 2
+		}
+
+		// Collect the download area from the bounding box and the polygon file.
+		var polygons []Polygon
+		if *bbox != "" {
+			polygon, err := parseBBox(*bbox)
+			if err != nil {
+				log.Print(err)
+				return 2
+			}
+			polygons = append(polygons, Polygon{Outer: polygon})
+		}
+		if *polygonFile != "" {
+			filePolygons, err := readPolygonFile(*polygonFile)
+			if err != nil {
+				log.Printf("Failed to read polygon file: %v", err)
+				return 2
+			}
+			polygons = append(polygons, filePolygons...)
+		}
+
+		req := DownloadRequest{
+			MinZoom:       *minZoom,
+			MaxZoom:       *maxZoom,
+			MapStyle:      mapStyle,
+			ConvertTo8Bit: *convertTo8Bit,
+			Refresh:       *refresh,
+		}
+		req.setAreas(polygons)
+		if *refresh == refreshOlder {
+			req.RefreshDays = *refreshDays
+		}
+		if err := validateDownloadRequest(req); err != nil {
+			log.Print(err)
+			return 2
+		}
+		m = newJobManifest(req, false)
+	}
+
+	if err := os.MkdirAll(*cacheDir, 0755); err != nil {
+		log.Printf("Failed to create cache directory: %v", err)
+		return 1
+	}
+	removeTempFiles(getStyleCacheDir(getStyleName(m.Request.MapStyle)))
+
+	// Cancel the download on Ctrl+C or SIGTERM.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	store, err := getTileStore(getStyleName(m.Request.MapStyle), true)
+	if err != nil {
+		log.Printf("Failed to open tile storage: %v", err)
+		return 1
+	}
+	defer closeTileStores()
+
+	// Track the progress in the job manifest, so an interrupted download can be resumed.
+	jobProgress, tilesToDownload := newJobProgress(m)
+
+	progress := &cliProgress{}
+	downloadTiles(ctx, progress.send, tilesToDownload, m.Request, store, jobProgress.record)
+
+	if ctx.Err() != nil {
+		jobProgress.save()
+		fmt.Printf("Download cancelled. Resume it with \"download -resume %s\".\n", m.ID)
+		return 1
+	}
+	failed := jobProgress.complete()
+	fmt.Printf("Download complete: %d downloaded, %d skipped, %d missing, %d failed, %d total\n",
+		progress.downloaded, progress.skipped, progress.missing, len(progress.failed), progress.total)
+	if len(progress.failed) > 0 {
+		fmt.Printf("Failed tiles: %s\n", strings.Join(progress.failed, ", "))
+	}
+	if failed > 0 {
+		fmt.Printf("Retry the failed tiles with \"download -resume %s\".\n", m.ID)
+		return 1
+	}
+	return 0
+}
+
+// resolveMapSource returns the tile URL template for a map source name or URL template.
+func resolveMapSource(source string) (string, error) {
+	if s, ok := lookupMapSource(source); ok {
+		return s.URL, nil
+	}
+	if strings.Contains(source, "{") {
+		if err := validateURLTemplate(source, nil); err != nil {
+			return "", err
+		}
+		return source, nil
+	}
+	names, _ := listMapSources()
+	sort.Strings(names)
+	return "", fmt.Errorf("unknown map source %q (available: %s)", source, strings.Join(names, ", "))
+}
+
+// parseBBox parses a W,S,E,N bounding box into a rectangular polygon.
+func parseBBox(s string) ([]LatLng, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("invalid bbox %q (expected W,S,E,N)", s)
+	}
+	var v [4]float64
+	for i, part := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bbox %q: %w", s, err)
+		}
+		v[i] = f
+	}
+	west, south, east, north := v[0], v[1], v[2], v[3]
+	if west < -180 || east > 180 || south < -90 || north > 90 || west >= east || south >= north {
+		return nil, fmt.Errorf("invalid bbox %q (must be W,S,E,N with W < E and S < N)", s)
+	}
+	// Web Mercator tiles end at about 85°, so a bbox up to the poles covers the outermost tiles.
+	south = max(south, -maxMercatorLatitude)
+	north = min(north, maxMercatorLatitude)
+	if south >= north {
+		return nil, fmt.Errorf("invalid bbox %q (must be within the Web Mercator latitudes of ±%g)", s, maxMercatorLatitude)
+	}
+	return []LatLng{
+		{Lat: north, Lng: west},
+		{Lat: north, Lng: east},
+		{Lat: south, Lng: east},
+		{Lat: south, Lng: west},
+	}, nil
+}
+
+// cliProgress prints the progress of a download to stdout.
+type cliProgress struct {
+	total      int
+	downloaded int
+	skipped    int
+	missing    int
+	failed     []string // The failed tiles (z/x/y) and why they failed.
+	lastStep   int
+}
+
+// send is a messageSender that counts the tiles and prints the progress in steps of one percent.
+func (p *cliProgress) send(msg WSMessage) error {
+	switch msg.Type {
+	case "download_started":
+		if data, ok := msg.Data.(map[string]int); ok {
+			p.total = data["total_tiles"]
+		}
+		fmt.Printf("Downloading %d tiles\n", p.total)
+		return nil
+	case "tile_downloaded":
+		p.downloaded++
+	case "tile_skipped":
+		p.skipped++
+	case "tile_missing":
+		p.missing++
+	case "tile_failed":
+		if data, ok := msg.Data.(map[string]string); ok {
+			p.failed = append(p.failed, fmt.Sprintf("%s (%s)", data["tile"], data["reason"]))
+		}
+	case "download_paused":
+		if data, ok := msg.Data.(map[string]interface{}); ok {
+			if until, ok := data["until"].(time.Time); ok {
+				fmt.Printf("Paused: %s, resuming at %s\n", data["reason"], until.Format(time.TimeOnly))
+			}
+		}
+		return nil
+	case "download_resumed":
+		fmt.Println("Resumed")
+		return nil
+	default:
+		return nil
+	}
+
+	processed := p.downloaded + p.skipped + p.missing + len(p.failed)
+	if p.total == 0 {
+		return nil
+	}
+	step := processed * 100 / p.total
+	if step != p.lastStep || processed == p.total {
+		p.lastStep = step
+		fmt.Printf("%3d%% (%d/%d) downloaded: %d, skipped: %d, missing: %d, failed: %d\n",
+			step, processed, p.total, p.downloaded, p.skipped, p.missing, len(p.failed))
+	}
+	return nil
+}
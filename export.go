@@ -0,0 +1,192 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// exportOptions limits which cached tiles are exported and describes the export.
+type exportOptions struct {
+	Polygons    []Polygon // The polygons to export. All tiles are exported if empty.
+	MinZoom     int       // The minimum zoom level to export.
+	MaxZoom     int       // The maximum zoom level to export.
+	Name        string    // The name of the tileset.
+	Attribution string    // The attribution of the map source.
+}
+
+// includes checks if a tile is part of the export.
+func (o exportOptions) includes(tile Tile) bool {
+	if int(tile.Z) < o.MinZoom || int(tile.Z) > o.MaxZoom {
+		return false
+	}
+	if len(o.Polygons) == 0 {
+		return true
+	}
+	bounds := tileBounds(tile)
+	for _, polygon := range o.Polygons {
+		if polygon.coversTile(bounds) {
+			return true
+		}
+	}
+	return false
+}
+
+// exportSummary collects the bounds, zoom levels and format of the exported tiles.
+type exportSummary struct {
+	count            int
+	bounds           BoundingBox
+	minZoom, maxZoom uint32
+	format           string
+	gzipped          bool // The vector tiles are gzip compressed.
+	mixedFormats     bool // A tile with another format than the first tile was exported.
+}
+
+// newExportSummary returns an empty export summary.
+func newExportSummary() *exportSummary {
+	return &exportSummary{
+		bounds:  BoundingBox{North: -90, South: 90, East: -180, West: 180},
+		minZoom: math.MaxUint32,
+	}
+}
+
+// add records an exported tile in a format.
+// The format of the first tile is the format of the export, as MBTiles and PMTiles have a single format.
+func (s *exportSummary) add(tile Tile, data []byte, format string) {
+	bounds := tileBounds(tile)
+	s.bounds.North = math.Max(s.bounds.North, bounds.North)
+	s.bounds.South = math.Min(s.bounds.South, bounds.South)
+	s.bounds.East = math.Max(s.bounds.East, bounds.East)
+	s.bounds.West = math.Min(s.bounds.West, bounds.West)
+	s.minZoom = min(s.minZoom, tile.Z)
+	s.maxZoom = max(s.maxZoom, tile.Z)
+	if s.format == "" {
+		s.format = format
+		s.gzipped = format == "pbf" && sniffTileFormat(data) == "pbf"
+	} else if format != s.format && !s.mixedFormats {
+		log.Printf("Tile %d/%d/%d is %s, but the export is %s", tile.Z, tile.X, tile.Y, format, s.format)
+		s.mixedFormats = true
+	}
+	s.count++
+}
+
+// compression returns the PMTiles compression of the exported tiles.
+func (s *exportSummary) compression() uint8 {
+	if s.gzipped {
+		return pmtilesCompressGzip
+	}
+	return pmtilesCompressNone
+}
+
+// runExportCommand exports a style cache directory into a single file and returns the exit code.
+func runExportCommand(args []string) int {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	registerCacheDirFlag(fs)
+	registerSourcesFlag(fs)
+	source := fs.String("source", "OSM", "Name of the map source to export")
+	output := fs.String("output", "", "Output file (.mbtiles or .pmtiles)")
+	bbox := fs.String("bbox", "", "Only export tiles within the bounding box W,S,E,N")
+	polygonFile := fs.String("polygon", "", "Only export tiles within the polygons of a GeoJSON file")
+	minZoom := fs.Int("min-zoom", 0, "Minimum zoom level to export")
+	maxZoom := fs.Int("max-zoom", 30, "Maximum zoom level to export")
+	name := fs.String("name", "", "Name of the tileset (default: name of the map source)")
+	attribution := fs.String("attribution", "", "Attribution of the map source (default: attribution of the map source configuration)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s export [options]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if *output == "" {
+		log.Print("No output file given")
+		return 2
+	}
+	if *minZoom < 0 || *minZoom > *maxZoom {
+		log.Print("Invalid zoom range (min <= max)")
+		return 2
+	}
+
+	opts := exportOptions{
+		MinZoom:     *minZoom,
+		MaxZoom:     *maxZoom,
+		Name:        *name,
+		Attribution: *attribution,
+	}
+	if opts.Name == "" {
+		opts.Name = *source
+	}
+	if opts.Attribution == "" {
+		if err := loadMapSources(); err != nil {
+			log.Printf("Failed to load map sources: %v", err)
+			return 1
+		}
+		if s, ok := lookupMapSource(*source); ok {
+			opts.Attribution = s.Attribution
+		}
+	}
+	if *bbox != "" {
+		polygon, err := parseBBox(*bbox)
+		if err != nil {
+			log.Print(err)
+			return 2
+		}
+		opts.Polygons = append(opts.Polygons, Polygon{Outer: polygon})
+	}
+	if *polygonFile != "" {
+		filePolygons, err := readPolygonFile(*polygonFile)
+		if err != nil {
+			log.Printf("Failed to read polygon file: %v", err)
+			return 2
+		}
+		opts.Polygons = append(opts.Polygons, filePolygons...)
+	}
+
+	src, err := getTileStore(*source, false)
+	if err != nil {
+		log.Printf("Failed to open map style: %v", err)
+		return 1
+	}
+	defer closeTileStores()
+
+	var count int
+	switch strings.ToLower(filepath.Ext(*output)) {
+	case ".mbtiles":
+		count, err = exportMBTiles(src, *output, opts)
+	case ".pmtiles":
+		count, err = exportPMTiles(src, *output, opts)
+	default:
+		log.Printf("Unsupported output format %q (supported: .mbtiles, .pmtiles)", filepath.Ext(*output))
+		return 2
+	}
+	if err != nil {
+		log.Printf("Export failed: %v", err)
+		return 1
+	}
+	fmt.Printf("Exported %d tiles to %s\n", count, *output)
+
+	missing, err := countMissingTiles(src, opts)
+	if err != nil {
+		log.Printf("Could not read missing tiles: %v", err)
+	} else if missing > 0 {
+		fmt.Printf("%d tiles of the selected area and zoom levels do not exist on the map source\n", missing)
+	}
+	return 0
+}
+
+// countMissingTiles returns the number of tiles of the export that the map source is known not to have.
+func countMissingTiles(src tileStore, opts exportOptions) (int, error) {
+	count := 0
+	err := src.WalkMissing(func(tile Tile) error {
+		if opts.includes(tile) {
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
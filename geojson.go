@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// geoJSONObject represents any GeoJSON object that can describe a download area.
+type geoJSONObject struct {
+	Type        string          `json:"type"`                  // The GeoJSON type (e.g., "Polygon").
+	Coordinates json.RawMessage `json:"coordinates,omitempty"` // The coordinates of a geometry.
+	Geometry    *geoJSONObject  `json:"geometry,omitempty"`    // The geometry of a feature.
+	Features    []geoJSONObject `json:"features,omitempty"`    // The features of a feature collection.
+	Geometries  []geoJSONObject `json:"geometries,omitempty"`  // The geometries of a geometry collection.
+}
+
+// readPolygonFile reads the polygons of a GeoJSON file with their holes.
+func readPolygonFile(path string) ([]Polygon, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var obj geoJSONObject
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return nil, fmt.Errorf("invalid GeoJSON: %w", err)
+	}
+	polygons, err := geoJSONPolygons(obj)
+	if err != nil {
+		return nil, err
+	}
+	if len(polygons) == 0 {
+		return nil, fmt.Errorf("no polygons found in %s", path)
+	}
+	return polygons, nil
+}
+
+// geoJSONPolygons returns all polygons in a GeoJSON object. Every part of a MultiPolygon is a polygon.
+func geoJSONPolygons(obj geoJSONObject) ([]Polygon, error) {
+	var polygons []Polygon
+	switch obj.Type {
+	case "FeatureCollection":
+		for _, feature := range obj.Features {
+			p, err := geoJSONPolygons(feature)
+			if err != nil {
+				return nil, err
+			}
+			polygons = append(polygons, p...)
+		}
+	case "Feature":
+		if obj.Geometry != nil {
+			return geoJSONPolygons(*obj.Geometry)
+		}
+	case "GeometryCollection":
+		for _, geometry := range obj.Geometries {
+			p, err := geoJSONPolygons(geometry)
+			if err != nil {
+				return nil, err
+			}
+			polygons = append(polygons, p...)
+		}
+	case "Polygon":
+		var rings [][][]float64
+		if err := json.Unmarshal(obj.Coordinates, &rings); err != nil {
+			return nil, fmt.Errorf("invalid Polygon coordinates: %w", err)
+		}
+		if len(rings) > 0 {
+			polygons = append(polygons, geoJSONPolygon(rings))
+		}
+	case "MultiPolygon":
+		var multi [][][][]float64
+		if err := json.Unmarshal(obj.Coordinates, &multi); err != nil {
+			return nil, fmt.Errorf("invalid MultiPolygon coordinates: %w", err)
+		}
+		for _, rings := range multi {
+			if len(rings) > 0 {
+				polygons = append(polygons, geoJSONPolygon(rings))
+			}
+		}
+	default:
+		// Points and lines do not describe an area and are ignored.
+	}
+	return polygons, nil
+}
+
+// geoJSONPolygon converts the rings of a GeoJSON polygon to a polygon.
+// The first ring is the outer ring, the others are holes.
+func geoJSONPolygon(rings [][][]float64) Polygon {
+	polygon := Polygon{Outer: geoJSONRing(rings[0])}
+	for _, ring := range rings[1:] {
+		if hole := geoJSONRing(ring); len(hole) >= 3 {
+			polygon.Holes = append(polygon.Holes, hole)
+		}
+	}
+	return polygon
+}
+
+// geoJSONRing converts a GeoJSON linear ring ([lng, lat] positions) to a list of points.
+func geoJSONRing(ring [][]float64) []LatLng {
+	points := make([]LatLng, 0, len(ring))
+	for _, position := range ring {
+		if len(position) < 2 {
+			continue
+		}
+		points = append(points, LatLng{Lat: position[1], Lng: position[0]})
+	}
+	// GeoJSON rings repeat the first position at the end.
+	if len(points) > 1 && points[0] == points[len(points)-1] {
+		points = points[:len(points)-1]
+	}
+	return points
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// square returns a ring around a rectangle of coordinates.
+func square(west, south, east, north float64) []LatLng {
+	return []LatLng{{Lat: north, Lng: west}, {Lat: north, Lng: east}, {Lat: south, Lng: east}, {Lat: south, Lng: west}}
+}
+
+func TestPolygonCoversTile(t *testing.T) {
+	// An area of 10° × 10° with a hole of 6° × 6° in the middle. Tiles of zoom level 8 are about 1.4° wide.
+	area := Polygon{Outer: square(0, 0, 10, 10), Holes: [][]LatLng{square(2, 2, 8, 8)}}
+	tileAt := func(lat, lng float64) Tile {
+		x, y := latLonToTile(lat, lng, 8)
+		return Tile{X: x, Y: y, Z: 8}
+	}
+	tests := []struct {
+		name    string
+		polygon Polygon
+		tile    Tile
+		want    bool
+	}{
+		{"inside the hole", area, tileAt(5, 5), false},
+		{"across the edge of the hole", area, tileAt(5, 2), true},
+		{"between the edges", area, tileAt(5, 1), true},
+		{"across the edge of the area", area, tileAt(5, 0), true},
+		{"outside the area", area, tileAt(5, 20), false},
+		{"without the hole", Polygon{Outer: area.Outer}, tileAt(5, 5), true},
+		{"hole with too few points", Polygon{Outer: area.Outer, Holes: [][]LatLng{square(2, 2, 8, 8)[:2]}}, tileAt(5, 5), true},
+		{
+			// A U-shaped hole contains all corners of the tile, but its gap runs through the tile.
+			name: "concave hole",
+			polygon: Polygon{Outer: area.Outer, Holes: [][]LatLng{{
+				{Lat: 8, Lng: 2}, {Lat: 8, Lng: 4.9}, {Lat: 3, Lng: 4.9}, {Lat: 3, Lng: 5.1},
+				{Lat: 8, Lng: 5.1}, {Lat: 8, Lng: 8}, {Lat: 2, Lng: 8}, {Lat: 2, Lng: 2},
+			}}},
+			tile: tileAt(5, 5),
+			want: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.polygon.coversTile(tileBounds(tt.tile)); got != tt.want {
+				t.Errorf("coversTile(%s) = %v, want %v", tileKey(tt.tile), got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetTilesForPolygonsWithHoles(t *testing.T) {
+	area := Polygon{Outer: square(0, 0, 10, 10), Holes: [][]LatLng{square(2, 2, 8, 8)}}
+	all := len(getTilesForPolygons([]Polygon{{Outer: area.Outer}}, 8, 8))
+	withHole := len(getTilesForPolygons([]Polygon{area}, 8, 8))
+	if withHole == 0 || withHole >= all {
+		t.Errorf("got %d tiles with the hole and %d without, want fewer but some with the hole", withHole, all)
+	}
+
+	// Another polygon covers the hole again.
+	filled := len(getTilesForPolygons([]Polygon{area, {Outer: square(2, 2, 8, 8)}}, 8, 8))
+	if filled != all {
+		t.Errorf("got %d tiles with the hole covered by another polygon, want %d", filled, all)
+	}
+}
+
+func TestReadPolygonFile(t *testing.T) {
+	const outer = `[[0, 0], [10, 0], [10, 10], [0, 10], [0, 0]]`
+	const hole = `[[2, 2], [8, 2], [8, 8], [2, 8], [2, 2]]`
+	tests := []struct {
+		name  string
+		doc   string
+		holes []int // The number of holes of every polygon.
+		valid bool
+	}{
+		{
+			name:  "polygon",
+			doc:   `{"type": "Polygon", "coordinates": [` + outer + `]}`,
+			holes: []int{0},
+			valid: true,
+		},
+		{
+			name:  "polygon with a hole",
+			doc:   `{"type": "Polygon", "coordinates": [` + outer + `, ` + hole + `]}`,
+			holes: []int{1},
+			valid: true,
+		},
+		{
+			name:  "multipolygon",
+			doc:   `{"type": "MultiPolygon", "coordinates": [[` + outer + `, ` + hole + `, ` + hole + `], [` + outer + `]]}`,
+			holes: []int{2, 0},
+			valid: true,
+		},
+		{
+			name:  "feature",
+			doc:   `{"type": "Feature", "properties": {}, "geometry": {"type": "Polygon", "coordinates": [` + outer + `, ` + hole + `]}}`,
+			holes: []int{1},
+			valid: true,
+		},
+		{
+			name: "feature collection with a geometry collection",
+			doc: `{"type": "FeatureCollection", "features": [
+				{"type": "Feature", "geometry": {"type": "GeometryCollection", "geometries": [
+					{"type": "Point", "coordinates": [5, 5]},
+					{"type": "Polygon", "coordinates": [` + outer + `]},
+					{"type": "MultiPolygon", "coordinates": [[` + outer + `, ` + hole + `]]}
+				]}},
+				{"type": "Feature", "geometry": {"type": "LineString", "coordinates": [[0, 0], [1, 1]]}}
+			]}`,
+			holes: []int{0, 1},
+			valid: true,
+		},
+		{
+			name: "hole with too few points",
+			doc:  `{"type": "Polygon", "coordinates": [` + outer + `, [[2, 2], [8, 2], [2, 2]]]}`,
+			// A degenerate hole is dropped.
+			holes: []int{0},
+			valid: true,
+		},
+		{
+			name: "only lines",
+			doc:  `{"type": "LineString", "coordinates": [[0, 0], [1, 1]]}`,
+		},
+		{
+			name: "invalid coordinates",
+			doc:  `{"type": "Polygon", "coordinates": [[0, 0]]}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "area.geojson")
+			if err := os.WriteFile(path, []byte(tt.doc), 0644); err != nil {
+				t.Fatal(err)
+			}
+			polygons, err := readPolygonFile(path)
+			if (err == nil) != tt.valid {
+				t.Fatalf("got error %v, want valid: %v", err, tt.valid)
+			}
+			if err != nil {
+				return
+			}
+			if len(polygons) != len(tt.holes) {
+				t.Fatalf("got %d polygons, want %d", len(polygons), len(tt.holes))
+			}
+			for i, polygon := range polygons {
+				if len(polygon.Outer) != 4 || len(polygon.Holes) != tt.holes[i] {
+					t.Errorf("polygon %d: got %d points and %d holes, want 4 points and %d holes", i, len(polygon.Outer), len(polygon.Holes), tt.holes[i])
+				}
+			}
+
+			// The polygons can be downloaded with their holes.
+			req := DownloadRequest{MinZoom: 8, MaxZoom: 8, MapStyle: "https://tile.example.com/{z}/{x}/{y}.png"}
+			req.setAreas(polygons)
+			if err := validateDownloadRequest(req); err != nil {
+				t.Fatalf("validateDownloadRequest: %v", err)
+			}
+			for i, polygon := range req.areas() {
+				if len(polygon.Holes) != tt.holes[i] {
+					t.Errorf("polygon %d of the request: got %d holes, want %d", i, len(polygon.Holes), tt.holes[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// Flags of the HTTP client for tile requests and downloaded documents.
+var (
+	proxyURL       *string
+	requestTimeout *time.Duration
+	connectTimeout *time.Duration
+	caCertFile     *string
+	clientCertFile *string
+	clientKeyFile  *string
+	sourceAddress  *string
+)
+
+// httpClient sends all outgoing requests. It is replaced by configureHTTPClient after the flags are parsed.
+var httpClient = http.DefaultClient
+
+// registerHTTPClientFlags registers the flags of the HTTP client.
+func registerHTTPClientFlags(fs *flag.FlagSet) {
+	proxyURL = fs.String("proxy", "", "Proxy for all requests, e.g. http://proxy:3128 or socks5://localhost:1080 (default: HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables)")
+	requestTimeout = fs.Duration("timeout", 60*time.Second, "Timeout of a request including reading the response (0 for none)")
+	connectTimeout = fs.Duration("connect-timeout", 10*time.Second, "Timeout for connecting to a server, including the TLS handshake (0 for none)")
+	caCertFile = fs.String("ca-cert", "", "PEM file with additional CA certificates to trust, e.g. of a private tile server")
+	clientCertFile = fs.String("client-cert", "", "PEM file with a client certificate for tile servers that require one")
+	clientKeyFile = fs.String("client-key", "", "PEM file with the private key of the client certificate (default: the client certificate file)")
+	sourceAddress = fs.String("source-address", "", "Local IP address to send requests from")
+}
+
+// configureHTTPClient replaces the HTTP client with one configured by the flags.
+func configureHTTPClient() error {
+	client, err := newHTTPClient()
+	if err != nil {
+		return err
+	}
+	httpClient = client
+	return nil
+}
+
+// newHTTPClient returns an HTTP client configured by the flags.
+func newHTTPClient() (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if *proxyURL != "" {
+		proxy, err := url.Parse(*proxyURL)
+		if err != nil || proxy.Host == "" {
+			return nil, fmt.Errorf("invalid proxy %q", *proxyURL)
+		}
+		switch proxy.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return nil, fmt.Errorf("unsupported proxy scheme %q (must be http, https, socks5 or socks5h)", proxy.Scheme)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	dialer := &net.Dialer{Timeout: *connectTimeout, KeepAlive: 30 * time.Second}
+	if *sourceAddress != "" {
+		ip := net.ParseIP(*sourceAddress)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid source address %q (must be an IP address)", *sourceAddress)
+		}
+		dialer.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+	transport.DialContext = dialer.DialContext
+	transport.TLSHandshakeTimeout = *connectTimeout
+
+	tlsConfig, err := newTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	return &http.Client{Transport: transport, Timeout: *requestTimeout}, nil
+}
+
+// newTLSConfig returns the TLS configuration with the additional CA certificates and the client certificate of the flags.
+func newTLSConfig() (*tls.Config, error) {
+	config := &tls.Config{}
+	if *caCertFile != "" {
+		pem, err := os.ReadFile(*caCertFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read CA certificates: %w", err)
+		}
+		// The CA certificates are trusted in addition to the ones of the system.
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", *caCertFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if *clientCertFile == "" {
+		if *clientKeyFile != "" {
+			return nil, errors.New("client-key requires client-cert")
+		}
+		return config, nil
+	}
+	keyFile := *clientKeyFile
+	if keyFile == "" {
+		keyFile = *clientCertFile
+	}
+	cert, err := tls.LoadX509KeyPair(*clientCertFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not load client certificate: %w", err)
+	}
+	config.Certificates = []tls.Certificate{cert}
+	return config, nil
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// jobState is the state of a download job.
+type jobState string
+
+const (
+	jobQueued    jobState = "queued"    // The job waits for a running job to finish.
+	jobRunning   jobState = "running"   // The job is downloading tiles.
+	jobPaused    jobState = "paused"    // The job waits because the tile server refused too many requests.
+	jobDone      jobState = "done"      // All tiles of the job were downloaded or skipped.
+	jobFailed    jobState = "failed"    // The job could not be run or some tiles failed to download.
+	jobCancelled jobState = "cancelled" // The job was cancelled.
+)
+
+// maxFinishedJobs is the number of finished jobs that are kept for the job list.
+const maxFinishedJobs = 100
+
+// downloadJob is a download job managed by the job manager.
+type downloadJob struct {
+	ID     string             // The ID of the job.
+	owner  interface{}        // The client that started the job.
+	send   messageSender      // Delivers the progress messages of the job to its client.
+	ctx    context.Context    // The context of the job.
+	cancel context.CancelFunc // Cancels the job.
+
+	mutex      sync.Mutex
+	manifest   jobManifest  // The manifest of a job that is not running.
+	progress   *jobProgress // The progress of a running or finished job.
+	state      jobState
+	err        string
+	queuedAt   time.Time
+	startedAt  time.Time
+	finishedAt time.Time
+}
+
+// getState returns the state of the job.
+func (j *downloadJob) getState() jobState {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.state
+}
+
+// finished checks if a job state is final.
+func (s jobState) finished() bool {
+	return s == jobDone || s == jobFailed || s == jobCancelled
+}
+
+// jobManager runs download jobs one after another, or a few at the same time.
+type jobManager struct {
+	mutex      sync.Mutex
+	maxRunning int                     // The maximum number of jobs that run at the same time.
+	running    int                     // The number of running jobs.
+	jobs       map[string]*downloadJob // All known jobs by ID.
+	order      []*downloadJob          // All known jobs in the order they were submitted.
+	queue      []*downloadJob          // The queued jobs, first in first out.
+}
+
+// downloadJobs manages the download jobs of the web server.
+var downloadJobs = newJobManager(1)
+
+// newJobManager returns a job manager that runs up to maxRunning jobs at the same time.
+func newJobManager(maxRunning int) *jobManager {
+	return &jobManager{
+		maxRunning: max(maxRunning, 1),
+		jobs:       make(map[string]*downloadJob),
+	}
+}
+
+// submit queues a new or resumed job and returns it with the number of jobs ahead of it.
+func (m *jobManager) submit(manifest jobManifest, send messageSender, owner interface{}) (*downloadJob, int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if job, ok := m.jobs[manifest.ID]; ok && !job.getState().finished() {
+		return nil, 0, fmt.Errorf("download job %s is already %s", manifest.ID, job.getState())
+	}
+
+	// Jobs without a client, e.g. from the REST API, discard their progress messages.
+	if send == nil {
+		send = func(WSMessage) error { return nil }
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &downloadJob{
+		ID:       manifest.ID,
+		owner:    owner,
+		send:     send,
+		ctx:      ctx,
+		cancel:   cancel,
+		manifest: manifest,
+		state:    jobQueued,
+		queuedAt: time.Now(),
+	}
+	// Queued jobs are saved as well, so they survive a restart.
+	saveJobManifest(manifest)
+
+	m.jobs[job.ID] = job
+	m.order = append(m.order, job)
+	m.queue = append(m.queue, job)
+	position := len(m.queue) - 1 + m.running
+	m.pruneLocked()
+	m.scheduleLocked()
+	return job, position, nil
+}
+
+// scheduleLocked starts queued jobs while fewer than maxRunning jobs are running.
+func (m *jobManager) scheduleLocked() {
+	for m.running < m.maxRunning && len(m.queue) > 0 {
+		job := m.queue[0]
+		m.queue = m.queue[1:]
+		m.running++
+		job.mutex.Lock()
+		job.state = jobRunning
+		job.startedAt = time.Now()
+		job.mutex.Unlock()
+		go m.run(job)
+	}
+}
+
+// pruneLocked forgets the oldest finished jobs if there are too many.
+func (m *jobManager) pruneLocked() {
+	finished := 0
+	for _, job := range m.order {
+		if job.getState().finished() {
+			finished++
+		}
+	}
+	kept := m.order[:0]
+	for _, job := range m.order {
+		if finished > maxFinishedJobs && job.getState().finished() {
+			// A resumed job has the same ID as its earlier run, which must not remove the entry of the resumed job.
+			if m.jobs[job.ID] == job {
+				delete(m.jobs, job.ID)
+			}
+			finished--
+			continue
+		}
+		kept = append(kept, job)
+	}
+	m.order = kept
+}
+
+// run downloads the tiles of a job and starts the next queued job afterwards.
+func (m *jobManager) run(job *downloadJob) {
+	defer func() {
+		m.mutex.Lock()
+		m.running--
+		m.scheduleLocked()
+		m.mutex.Unlock()
+	}()
+
+	job.mutex.Lock()
+	manifest := job.manifest
+	job.mutex.Unlock()
+
+	if manifest.World {
+		log.Printf("Starting world download (job %s), map style: %s", job.ID, manifest.Request.MapStyle)
+	} else {
+		log.Printf("Starting download (job %s) for area: %v, zoom: %d-%d, map style: %s", job.ID, manifest.Request.Polygons, manifest.Request.MinZoom, manifest.Request.MaxZoom, manifest.Request.MapStyle)
+	}
+
+	// Get the style name and tile store.
+	store, err := getTileStore(getStyleName(manifest.Request.MapStyle), true)
+	if err != nil {
+		job.finish(jobFailed, fmt.Sprintf("Could not open tile storage: %v", err))
+		job.sendMessage("error", map[string]string{"message": job.err})
+		return
+	}
+
+	// Get the list of tiles to download and track the progress in the job manifest.
+	progress, tilesToDownload := newJobProgress(manifest)
+	job.mutex.Lock()
+	job.progress = progress
+	job.mutex.Unlock()
+
+	// Start the tile download process. The job is paused while the tile server refuses requests.
+	send := func(msg WSMessage) error {
+		switch msg.Type {
+		case "download_paused":
+			job.setState(jobPaused)
+		case "download_resumed":
+			job.setState(jobRunning)
+		}
+		return job.send(msg)
+	}
+	downloadTiles(job.ctx, send, tilesToDownload, manifest.Request, store, progress.record)
+
+	// A cancelled job can be resumed like one that was interrupted by a restart, or discarded.
+	if job.ctx.Err() != nil {
+		progress.save()
+		job.finish(jobCancelled, "")
+		return
+	}
+	// The manifest is kept while tiles failed, so they can be retried by resuming the job.
+	if failed := progress.complete(); failed > 0 {
+		job.finish(jobFailed, fmt.Sprintf("%d tiles failed to download, resume the job to retry them", failed))
+	} else {
+		job.finish(jobDone, "")
+	}
+	job.sendMessage("download_complete", nil)
+}
+
+// setState sets the state of a job that has not finished.
+func (j *downloadJob) setState(state jobState) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if !j.state.finished() {
+		j.state = state
+	}
+}
+
+// finish sets the final state of a job.
+func (j *downloadJob) finish(state jobState, err string) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.state = state
+	j.err = err
+	j.finishedAt = time.Now()
+	j.cancel()
+}
+
+// sendMessage sends a message about the job to its client.
+func (j *downloadJob) sendMessage(msgType string, data interface{}) {
+	if err := j.send(WSMessage{Type: msgType, Data: data}); err != nil {
+		log.Println("Error sending message:", err)
+	}
+}
+
+// get returns a job by ID.
+func (m *jobManager) get(id string) (*downloadJob, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	job, ok := m.jobs[id]
+	return job, ok
+}
+
+// list returns all known jobs in the order they were submitted.
+func (m *jobManager) list() []*downloadJob {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]*downloadJob(nil), m.order...)
+}
+
+// errJobNotFound is returned for unknown job IDs.
+var errJobNotFound = errors.New("download job not found")
+
+// cancel cancels a queued or running job. Its manifest is kept, so it can be resumed later.
+func (m *jobManager) cancel(id string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	job, ok := m.jobs[id]
+	if !ok {
+		return errJobNotFound
+	}
+	return m.cancelLocked(job)
+}
+
+// cancelOwner cancels all queued and running jobs of a client and returns their number.
+func (m *jobManager) cancelOwner(owner interface{}) int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	cancelled := 0
+	for _, job := range m.order {
+		if job.owner == owner && m.cancelLocked(job) == nil {
+			cancelled++
+		}
+	}
+	return cancelled
+}
+
+// cancelLocked cancels a job while the manager's mutex is held.
+func (m *jobManager) cancelLocked(job *downloadJob) error {
+	switch state := job.getState(); state {
+	case jobQueued:
+		for i, queued := range m.queue {
+			if queued == job {
+				m.queue = append(m.queue[:i], m.queue[i+1:]...)
+				break
+			}
+		}
+		job.finish(jobCancelled, "")
+	case jobRunning, jobPaused:
+		// The job finishes as cancelled once its workers have stopped.
+		job.cancel()
+	default:
+		return fmt.Errorf("download job %s is already %s", job.ID, state)
+	}
+	log.Printf("Download job %s cancelled", job.ID)
+	job.sendMessage("download_cancelled", nil)
+	return nil
+}
+
+// isActive checks if a job with the ID is queued or running.
+func (m *jobManager) isActive(id string) bool {
+	job, ok := m.get(id)
+	return ok && !job.getState().finished()
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// jobManifest is the persisted state of a download job, which allows resuming it after a restart.
+type jobManifest struct {
+	ID          string          `json:"id"`              // The ID of the job.
+	Request     DownloadRequest `json:"request"`         // The area, zoom levels, map source and options.
+	World       bool            `json:"world"`           // Whether the job downloads the world basemap instead of the polygons.
+	Tiles       []string        `json:"tiles,omitempty"` // The tiles (z/x/y) to download instead of the area, e.g. tiles deleted by an audit.
+	TotalTiles  int             `json:"total_tiles"`     // The number of tiles of the job.
+	Cursor      int             `json:"cursor"`          // All tiles before the cursor have been processed.
+	Downloaded  int             `json:"downloaded"`      // The number of downloaded tiles.
+	Skipped     int             `json:"skipped"`         // The number of tiles that already existed.
+	Missing     int             `json:"missing"`         // The number of tiles that the map source does not have.
+	FailedTiles []string        `json:"failed_tiles"`    // The tiles (z/x/y) that failed to download.
+	CreatedAt   time.Time       `json:"created_at"`      // The time the job was created.
+	UpdatedAt   time.Time       `json:"updated_at"`      // The time the manifest was last saved.
+}
+
+// tileStatus is the result of downloading a single tile.
+type tileStatus int
+
+const (
+	tileCancelled  tileStatus = iota // The download was cancelled before the tile was processed.
+	tileDownloaded                   // The tile was downloaded.
+	tileSkipped                      // The tile already existed.
+	tileFailed                       // The tile could not be downloaded.
+	tileMissing                      // The map source does not have the tile.
+)
+
+// jobSaveInterval is the minimum time between two saves of a job manifest.
+const jobSaveInterval = 2 * time.Second
+
+// newJobID returns a random job ID.
+func newJobID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// newJobManifest returns the manifest of a new download job.
+func newJobManifest(req DownloadRequest, world bool) jobManifest {
+	now := time.Now()
+	return jobManifest{
+		ID:        newJobID(),
+		Request:   req,
+		World:     world,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+}
+
+// getJobsDir returns the directory for the job manifests.
+func getJobsDir() string {
+	return filepath.Join(*cacheDir, ".jobs")
+}
+
+// jobManifestPath returns the path of a job manifest.
+func jobManifestPath(id string) string {
+	return filepath.Join(getJobsDir(), sanitizeStyleName(id)+".json")
+}
+
+// loadJobManifest loads the manifest of an unfinished job.
+func loadJobManifest(id string) (jobManifest, error) {
+	var m jobManifest
+	data, err := os.ReadFile(jobManifestPath(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return m, fmt.Errorf("no unfinished download job with ID %s", id)
+	}
+	if err != nil {
+		return m, err
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return m, fmt.Errorf("invalid job manifest %s: %w", id, err)
+	}
+	return m, nil
+}
+
+// loadJobManifests loads the manifests of all unfinished jobs, oldest first.
+func loadJobManifests() ([]jobManifest, error) {
+	files, err := filepath.Glob(filepath.Join(getJobsDir(), "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var manifests []jobManifest
+	for _, file := range files {
+		m, err := loadJobManifest(strings.TrimSuffix(filepath.Base(file), ".json"))
+		if err != nil {
+			log.Printf("Skipping job manifest: %v", err)
+			continue
+		}
+		manifests = append(manifests, m)
+	}
+	sort.Slice(manifests, func(i, j int) bool { return manifests[i].CreatedAt.Before(manifests[j].CreatedAt) })
+	return manifests, nil
+}
+
+// tiles returns all tiles of the job in download order.
+// Only the zoom levels and the area the map source provides are downloaded.
+func (m jobManifest) tiles() []Tile {
+	source := findMapSource(m.Request.MapStyle)
+	var allTiles []Tile
+	switch {
+	case len(m.Tiles) > 0:
+		for _, key := range m.Tiles {
+			if tile, err := parseTileKey(key); err == nil {
+				allTiles = append(allTiles, tile)
+			}
+		}
+	case m.World:
+		allTiles = getWorldTiles()
+	default:
+		allTiles = getTilesForPolygons(m.Request.areas(), m.Request.MinZoom, m.Request.MaxZoom)
+	}
+	var tiles []Tile
+	for _, tile := range allTiles {
+		if int(tile.Z) >= source.MinZoom && int(tile.Z) <= source.maxZoom() && source.covers(tile) {
+			tiles = append(tiles, tile)
+		}
+	}
+	return tiles
+}
+
+// tileKey returns the "z/x/y" key of a tile.
+func tileKey(tile Tile) string {
+	return fmt.Sprintf("%d/%d/%d", tile.Z, tile.X, tile.Y)
+}
+
+// parseTileKey parses a "z/x/y" tile key.
+func parseTileKey(key string) (Tile, error) {
+	var tile Tile
+	if _, err := fmt.Sscanf(key, "%d/%d/%d", &tile.Z, &tile.X, &tile.Y); err != nil {
+		return Tile{}, fmt.Errorf("invalid tile %q: %w", key, err)
+	}
+	return tile, nil
+}
+
+// describe returns a short human readable description of the job.
+func (m jobManifest) describe() string {
+	styleName := getStyleName(m.Request.MapStyle)
+	processed := m.Cursor
+	var refresh string
+	if m.Request.Refresh != "" && m.Request.Refresh != refreshSkip {
+		refresh = ", refresh " + m.Request.Refresh
+	}
+	var failed string
+	if len(m.FailedTiles) > 0 {
+		failed = fmt.Sprintf(", %d failed", len(m.FailedTiles))
+	}
+	if len(m.Tiles) > 0 {
+		return fmt.Sprintf("re-download of %d tile(s), map style %s%s, %d/%d tiles%s", len(m.Tiles), styleName, refresh, processed, m.TotalTiles, failed)
+	}
+	if m.World {
+		return fmt.Sprintf("world basemap, map style %s%s, %d/%d tiles%s", styleName, refresh, processed, m.TotalTiles, failed)
+	}
+	return fmt.Sprintf("%d area(s), zoom %d-%d, map style %s%s, %d/%d tiles%s",
+		len(m.Request.Polygons), m.Request.MinZoom, m.Request.MaxZoom, styleName, refresh, processed, m.TotalTiles, failed)
+}
+
+// jobProgress tracks the progress of a running job and saves it to the job manifest.
+type jobProgress struct {
+	mutex    sync.Mutex
+	manifest jobManifest
+	retries  int             // The number of failed tiles of a previous run that are downloaded first.
+	start    int             // The cursor when the job was started.
+	done     []bool          // The processed tiles after the start cursor.
+	failed   map[string]bool // The failed tiles, including tiles of a previous run that are not downloaded yet.
+	lastSave time.Time
+}
+
+// newJobProgress starts tracking a job and returns the tiles that still need to be downloaded.
+// Failed tiles of a previous run are retried before the tiles after the cursor.
+func newJobProgress(m jobManifest) (*jobProgress, []Tile) {
+	allTiles := m.tiles()
+	m.TotalTiles = len(allTiles)
+	if m.Cursor > len(allTiles) {
+		m.Cursor = len(allTiles)
+	}
+
+	p := &jobProgress{
+		manifest: m,
+		start:    m.Cursor,
+		done:     make([]bool, len(allTiles)-m.Cursor),
+		failed:   make(map[string]bool),
+	}
+	var tiles []Tile
+	for _, key := range m.FailedTiles {
+		tile, err := parseTileKey(key)
+		if err != nil {
+			continue
+		}
+		p.failed[key] = true
+		tiles = append(tiles, tile)
+	}
+	p.retries = len(tiles)
+	tiles = append(tiles, allTiles[m.Cursor:]...)
+	p.save()
+	return p, tiles
+}
+
+// record updates the progress with the result of the i-th tile returned by newJobProgress.
+func (p *jobProgress) record(i int, tile Tile, status tileStatus) {
+	if status == tileCancelled {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	key := tileKey(tile)
+	switch status {
+	case tileDownloaded:
+		p.manifest.Downloaded++
+		delete(p.failed, key)
+	case tileSkipped:
+		p.manifest.Skipped++
+		delete(p.failed, key)
+	case tileMissing:
+		p.manifest.Missing++
+		delete(p.failed, key)
+	case tileFailed:
+		p.failed[key] = true
+	}
+
+	// Move the cursor over all processed tiles.
+	if i >= p.retries {
+		p.done[i-p.retries] = true
+		for p.manifest.Cursor-p.start < len(p.done) && p.done[p.manifest.Cursor-p.start] {
+			p.manifest.Cursor++
+		}
+	}
+
+	if time.Since(p.lastSave) >= jobSaveInterval {
+		p.saveLocked()
+	}
+}
+
+// failedTiles returns the sorted failed tiles.
+func (p *jobProgress) failedTiles() []string {
+	failed := make([]string, 0, len(p.failed))
+	for key := range p.failed {
+		failed = append(failed, key)
+	}
+	sort.Strings(failed)
+	return failed
+}
+
+// save writes the job manifest.
+func (p *jobProgress) save() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.saveLocked()
+}
+
+// saveLocked writes the job manifest while the mutex is held.
+func (p *jobProgress) saveLocked() {
+	p.lastSave = time.Now()
+	p.manifest.UpdatedAt = p.lastSave
+	p.manifest.FailedTiles = p.failedTiles()
+	saveJobManifest(p.manifest)
+}
+
+// snapshot returns a copy of the current manifest.
+func (p *jobProgress) snapshot() jobManifest {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	m := p.manifest
+	m.FailedTiles = p.failedTiles()
+	return m
+}
+
+// complete saves the job manifest of a finished job whose tiles failed, so they can be retried by resuming the job,
+// and deletes it otherwise. It returns the number of failed tiles.
+func (p *jobProgress) complete() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if len(p.failed) > 0 {
+		p.saveLocked()
+	} else {
+		removeJobManifest(p.manifest.ID)
+	}
+	return len(p.failed)
+}
+
+// saveJobManifest writes a job manifest.
+func saveJobManifest(m jobManifest) {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		log.Printf("Could not encode job manifest %s: %v", m.ID, err)
+		return
+	}
+	if err := os.MkdirAll(getJobsDir(), 0755); err != nil {
+		log.Printf("Could not create jobs directory: %v", err)
+		return
+	}
+	if err := writeFileAtomic(jobManifestPath(m.ID), data); err != nil {
+		log.Printf("Could not write job manifest %s: %v", m.ID, err)
+	}
+}
+
+// removeJobManifest deletes a job manifest.
+func removeJobManifest(id string) {
+	if err := os.Remove(jobManifestPath(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Could not remove job manifest %s: %v", id, err)
+	}
+}
+
+// logUnfinishedJobs logs the jobs that were interrupted by a restart.
+func logUnfinishedJobs() {
+	manifests, err := loadJobManifests()
+	if err != nil {
+		log.Printf("Could not load unfinished download jobs: %v", err)
+		return
+	}
+	for _, m := range manifests {
+		log.Printf("Unfinished download job %s: %s. Resume it in the web interface or with \"download -resume %s\".", m.ID, m.describe(), m.ID)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"context"
 	"embed" // Used for embedding files into the binary.
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"image"
@@ -47,15 +48,12 @@ var upgrader = websocket.Upgrader{
 
 // Global variables used throughout the application.
 var (
-	mapSources       map[string]string  // Stores the available map sources.
-	downloadCancel   context.CancelFunc // Function to cancel an ongoing download.
-	downloading      bool               // Flag to indicate if a download is in progress.
-	downloadingMutex sync.Mutex         // Mutex to protect access to the downloading flag.
-	cacheDir         *string
-	maxWorkers       *int
-	rateLimit        *int
-	maxRetries       *int
-	userAgent        *string
+	mapSources map[string]MapSource // Stores the available map sources, see sources.go.
+	cacheDir   *string
+	maxWorkers *int
+	rateLimit  *int
+	maxRetries *int
+	userAgent  *string
 )
 
 // generateUserAgent returns a basic user agent that identifies as a tile downloader
@@ -94,36 +92,91 @@ type LatLng struct {
 	Lng float64 `json:"lng"` // Longitude
 }
 
+// Polygon is an area with an outer ring and holes that are not part of the area.
+type Polygon struct {
+	Outer []LatLng   // The outer ring.
+	Holes [][]LatLng // The inner rings, e.g. lakes or cities that are excluded.
+}
+
 // DownloadRequest represents a request to download map tiles for a specific area.
 type DownloadRequest struct {
-	Polygons      [][]LatLng `json:"polygons"`        // The polygons defining the download area.
-	MinZoom       int        `json:"min_zoom"`        // The minimum zoom level to download.
-	MaxZoom       int        `json:"max_zoom"`        // The maximum zoom level to download.
-	MapStyle      string     `json:"map_style"`       // The URL of the map tile server.
-	ConvertTo8Bit bool       `json:"convert_to_8bit"` // Whether to convert images to 8-bit PNG.
+	Polygons      [][]LatLng   `json:"polygons"`               // The outer rings of the polygons defining the download area.
+	Holes         [][][]LatLng `json:"holes,omitempty"`        // The holes of the polygons by polygon index, which are not downloaded.
+	MinZoom       int          `json:"min_zoom"`               // The minimum zoom level to download.
+	MaxZoom       int          `json:"max_zoom"`               // The maximum zoom level to download.
+	MapStyle      string       `json:"map_style"`              // The URL of the map tile server.
+	ConvertTo8Bit bool         `json:"convert_to_8bit"`        // Whether to convert images to 8-bit PNG.
+	Refresh       string       `json:"refresh,omitempty"`      // How existing tiles are refreshed: skip, overwrite, older or expired.
+	RefreshDays   int          `json:"refresh_days,omitempty"` // The age in days after which tiles are refreshed in the "older" mode.
+}
+
+// areas returns the polygons of the download request with their holes.
+func (r DownloadRequest) areas() []Polygon {
+	polygons := make([]Polygon, len(r.Polygons))
+	for i, outer := range r.Polygons {
+		polygons[i].Outer = outer
+		if i < len(r.Holes) {
+			polygons[i].Holes = r.Holes[i]
+		}
+	}
+	return polygons
+}
+
+// setAreas sets the polygons and holes of the download request.
+// Holes are only set if a polygon has any, so requests without holes keep their format.
+func (r *DownloadRequest) setAreas(polygons []Polygon) {
+	r.Polygons = make([][]LatLng, len(polygons))
+	r.Holes = nil
+	for i, polygon := range polygons {
+		r.Polygons[i] = polygon.Outer
+		if len(polygon.Holes) > 0 {
+			if r.Holes == nil {
+				r.Holes = make([][][]LatLng, len(polygons))
+			}
+			r.Holes[i] = polygon.Holes
+		}
+	}
 }
 
 // WorldDownloadRequest represents a request to download map tiles for the entire world.
 type WorldDownloadRequest struct {
-	MapStyle      string `json:"map_style"`       // The URL of the map tile server.
-	ConvertTo8Bit bool   `json:"convert_to_8bit"` // Whether to convert images to 8-bit PNG.
+	MapStyle      string `json:"map_style"`              // The URL of the map tile server.
+	ConvertTo8Bit bool   `json:"convert_to_8bit"`        // Whether to convert images to 8-bit PNG.
+	Refresh       string `json:"refresh,omitempty"`      // How existing tiles are refreshed: skip, overwrite, older or expired.
+	RefreshDays   int    `json:"refresh_days,omitempty"` // The age in days after which tiles are refreshed in the "older" mode.
 }
 
 // WSMessage represents a WebSocket message with a type and data.
 type WSMessage struct {
-	Type string      `json:"type"` // The type of the message (e.g., "start_download").
-	Data interface{} `json:"data"` // The data associated with the message.
+	Type  string      `json:"type"`             // The type of the message (e.g., "start_download").
+	Data  interface{} `json:"data"`             // The data associated with the message.
+	JobID string      `json:"job_id,omitempty"` // The download job the message belongs to.
 }
 
 // main is the entry point of the application.
 func main() {
+	// Run a subcommand instead of the web server if one is given.
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "download":
+			os.Exit(runDownloadCommand(os.Args[2:]))
+		case "export":
+			os.Exit(runExportCommand(os.Args[2:]))
+		case "import-wmts":
+			os.Exit(runImportWMTSCommand(os.Args[2:]))
+		case "import-tilejson":
+			os.Exit(runImportTileJSONCommand(os.Args[2:]))
+		case "audit":
+			os.Exit(runAuditCommand(os.Args[2:]))
+		case "mock-server":
+			os.Exit(runMockServerCommand(os.Args[2:]))
+		}
+	}
+
 	// Command line flags
 	port := flag.Int("port", 8080, "Port number for the server")
-	cacheDir = flag.String("maps-directory", "maps", "Directory for storing map tiles. This is where the downloaded tiles will be saved.")
-	maxWorkers = flag.Int("max-workers", 4, "Number of concurrent download workers (max: 10)")
-	rateLimit = flag.Int("rate-limit", 10, "Maximum number of tiles to download per second (max: 50)")
-	maxRetries = flag.Int("max-retries", 3, "Maximum number of retries for downloading a tile")
-	userAgent = flag.String("user-agent", generateUserAgent(), "User-Agent header for HTTP requests")
+	maxJobs := flag.Int("max-jobs", 1, "Number of download jobs that run at the same time (max: 4)")
+	registerDownloadFlags(flag.CommandLine)
 	help := flag.Bool("help", false, "Show help message")
 
 	flag.Parse()
@@ -133,23 +186,30 @@ func main() {
 		return
 	}
 
-	if *maxWorkers > 10 {
-		log.Fatalf("max-workers cannot exceed 10 (got %d)", *maxWorkers)
+	if err := validateDownloadFlags(); err != nil {
+		log.Fatal(err)
 	}
 
-	if *rateLimit > 50 {
-		log.Fatalf("rate-limit cannot exceed 50 (got %d)", *rateLimit)
+	if *maxJobs < 1 || *maxJobs > 4 {
+		log.Fatalf("max-jobs must be between 1 and 4 (got %d)", *maxJobs)
 	}
+	downloadJobs = newJobManager(*maxJobs)
 
 	// Create cache directory if it doesn't exist.
 	if err := os.MkdirAll(*cacheDir, 0755); err != nil {
 		log.Fatalf("Failed to create cache directory: %v", err)
 	}
+	// Remove the temporary files of tiles that were being written when the application stopped.
+	go removeTempFiles(*cacheDir)
 
-	// Load map sources from the embedded JSON file.
-	if err := json.Unmarshal(mapSourcesJSON, &mapSources); err != nil {
+	// Load map sources from the embedded JSON file and the user sources files.
+	if err := loadMapSources(); err != nil {
 		log.Fatalf("Failed to load map sources: %v", err)
 	}
+	go watchMapSources()
+
+	// Tell the user about downloads that were interrupted by a restart.
+	logUnfinishedJobs()
 
 	// Register HTTP handlers for different routes.
 	http.HandleFunc("/favicon.ico", func(w http.ResponseWriter, r *http.Request) {
@@ -158,11 +218,24 @@ func main() {
 	})
 	http.HandleFunc("/", serveHome)
 	http.HandleFunc("/get_map_sources", getMapSources)
+	http.HandleFunc("POST /api/sources", sameOrigin(apiCreateSource))
+	http.HandleFunc("PUT /api/sources/{name}", sameOrigin(apiUpdateSource))
+	http.HandleFunc("DELETE /api/sources/{name}", sameOrigin(apiDeleteSource))
+	http.HandleFunc("POST /api/sources/import/wmts", sameOrigin(apiImportWMTS))
+	http.HandleFunc("POST /api/sources/import/tilejson", sameOrigin(apiImportTileJSON))
 	http.HandleFunc("/ws", wsHandler)
 
 	http.HandleFunc("/tiles/", serveTile)
 	http.HandleFunc("/get_cached_tiles/", getCachedTiles)
 
+	// REST API for download jobs, shared with the web interface.
+	http.HandleFunc("POST /api/jobs", sameOrigin(apiCreateJob))
+	http.HandleFunc("GET /api/jobs", apiListJobs)
+	http.HandleFunc("GET /api/jobs/{id}", apiGetJob)
+	http.HandleFunc("DELETE /api/jobs/{id}", sameOrigin(apiCancelJob))
+	http.HandleFunc("POST /api/jobs/{id}/resume", sameOrigin(apiResumeJob))
+	http.HandleFunc("POST /api/audit", sameOrigin(apiAudit))
+
 	staticFS, err := fs.Sub(staticFiles, "static")
 	if err != nil {
 		log.Fatal(err)
@@ -177,6 +250,37 @@ func main() {
 	}
 }
 
+// registerDownloadFlags registers the flags shared by the web server and the download command.
+func registerDownloadFlags(fs *flag.FlagSet) {
+	registerCacheDirFlag(fs)
+	registerSourcesFlag(fs)
+	maxWorkers = fs.Int("max-workers", 4, "Number of concurrent download workers (max: 10)")
+	rateLimit = fs.Int("rate-limit", 10, "Maximum number of tiles to download per second (max: 50)")
+	maxRetries = fs.Int("max-retries", 3, "Maximum number of retries for downloading a tile")
+	userAgent = fs.String("user-agent", generateUserAgent(), "User-Agent header for HTTP requests")
+	storage = fs.String("storage", "directory", "Storage for newly downloaded map styles: directory or mbtiles")
+	registerHTTPClientFlags(fs)
+}
+
+// registerCacheDirFlag registers the flag for the maps directory.
+func registerCacheDirFlag(fs *flag.FlagSet) {
+	cacheDir = fs.String("maps-directory", "maps", "Directory for storing map tiles. This is where the downloaded tiles will be saved.")
+}
+
+// validateDownloadFlags checks the values of the shared download flags and configures the HTTP client with them.
+func validateDownloadFlags() error {
+	if *maxWorkers > 10 {
+		return fmt.Errorf("max-workers cannot exceed 10 (got %d)", *maxWorkers)
+	}
+	if *rateLimit > 50 {
+		return fmt.Errorf("rate-limit cannot exceed 50 (got %d)", *rateLimit)
+	}
+	if *storage != "directory" && *storage != "mbtiles" {
+		return fmt.Errorf("storage must be directory or mbtiles (got %s)", *storage)
+	}
+	return configureHTTPClient()
+}
+
 // serveHome serves the main HTML page.
 func serveHome(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/html")
@@ -187,8 +291,13 @@ func serveHome(w http.ResponseWriter, r *http.Request) {
 
 // getMapSources serves the available map sources as JSON.
 func getMapSources(w http.ResponseWriter, r *http.Request) {
+	data, err := encodeMapSources()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error encoding map sources: %v", err), http.StatusInternalServerError)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
-	if _, err := w.Write(mapSourcesJSON); err != nil {
+	if _, err := w.Write(data); err != nil {
 		log.Printf("Could not write response: %v", err)
 	}
 }
@@ -207,6 +316,11 @@ func wsHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}()
 
+	client := &wsClient{conn: conn}
+
+	// Offer to resume the jobs that were interrupted by a restart.
+	sendUnfinishedJobs(client)
+
 	// Loop to read messages from the WebSocket connection.
 	for {
 		messageType, p, err := conn.ReadMessage()
@@ -227,139 +341,206 @@ func wsHandler(w http.ResponseWriter, r *http.Request) {
 				var req DownloadRequest
 				b, _ := json.Marshal(msg.Data)
 				if err := json.Unmarshal(b, &req); err != nil {
-					sendError(conn, "Invalid download request")
+					sendError(client, "Invalid download request")
 					continue
 				}
-				go handleStartDownload(conn, req)
+				handleStartDownload(client, req)
 			case "start_world_download":
 				var req WorldDownloadRequest
 				b, _ := json.Marshal(msg.Data)
 				if err := json.Unmarshal(b, &req); err != nil {
-					sendError(conn, "Invalid world download request")
+					sendError(client, "Invalid world download request")
 					continue
 				}
-				go handleStartWorldDownload(conn, req)
-			case "cancel_download":
-				handleCancelDownload(conn)
+				handleStartWorldDownload(client, req)
+			case "resume_download", "discard_download", "cancel_download":
+				var req struct {
+					ID string `json:"id"`
+				}
+				if msg.Data != nil {
+					b, _ := json.Marshal(msg.Data)
+					if err := json.Unmarshal(b, &req); err != nil {
+						sendError(client, "Invalid job ID")
+						continue
+					}
+				}
+				switch {
+				case msg.Type == "cancel_download":
+					handleCancelDownload(client, req.ID)
+				case req.ID == "":
+					sendError(client, "Invalid job ID")
+				case msg.Type == "resume_download":
+					handleResumeDownload(client, req.ID)
+				default:
+					handleDiscardDownload(client, req.ID)
+				}
 			}
 		}
 	}
 }
 
-// handleStartDownload starts a new download process for a defined area.
-func handleStartDownload(conn *websocket.Conn, req DownloadRequest) {
-	// Lock the mutex to ensure only one download runs at a time.
-	downloadingMutex.Lock()
-	if downloading {
-		sendError(conn, "Another download is already in progress.")
-		downloadingMutex.Unlock()
+// sendUnfinishedJobs sends the list of unfinished download jobs that are not queued or running.
+func sendUnfinishedJobs(client *wsClient) {
+	manifests, err := loadJobManifests()
+	if err != nil {
+		log.Printf("Could not load unfinished download jobs: %v", err)
 		return
 	}
-	downloading = true
-	downloadingMutex.Unlock()
+	jobs := make([]map[string]interface{}, 0, len(manifests))
+	for _, m := range manifests {
+		if downloadJobs.isActive(m.ID) {
+			continue
+		}
+		jobs = append(jobs, map[string]interface{}{
+			"id":          m.ID,
+			"description": m.describe(),
+			"updated_at":  m.UpdatedAt,
+		})
+	}
+	if len(jobs) > 0 {
+		sendMessage(client, "unfinished_jobs", jobs)
+	}
+}
 
-	// Defer setting the downloading flag to false.
-	defer func() {
-		downloadingMutex.Lock()
-		downloading = false
-		downloadingMutex.Unlock()
-	}()
+// handleStartDownload starts a new download process for a defined area.
+func handleStartDownload(client *wsClient, req DownloadRequest) {
+	// Validate the zoom range and polygons.
+	if err := validateDownloadRequest(req); err != nil {
+		sendError(client, err.Error())
+		return
+	}
 
-	log.Printf("Starting download for area: %v, zoom: %d-%d, map style: %s", req.Polygons, req.MinZoom, req.MaxZoom, req.MapStyle)
+	submitDownloadJob(client, newJobManifest(req, false))
+}
 
-	// Create a new context to allow for cancellation.
-	var ctx context.Context
-	ctx, downloadCancel = context.WithCancel(context.Background())
+// handleStartWorldDownload starts a new download process for the entire world.
+func handleStartWorldDownload(client *wsClient, req WorldDownloadRequest) {
+	if err := validateRefresh(req.Refresh, req.RefreshDays); err != nil {
+		sendError(client, err.Error())
+		return
+	}
+	submitDownloadJob(client, newJobManifest(DownloadRequest{
+		MapStyle:      req.MapStyle,
+		ConvertTo8Bit: req.ConvertTo8Bit,
+		Refresh:       req.Refresh,
+		RefreshDays:   req.RefreshDays,
+	}, true))
+}
 
-	// Get the style name and cache directory.
-	styleName := getStyleName(req.MapStyle)
-	styleCacheDir := getStyleCacheDir(styleName)
+// handleResumeDownload resumes an unfinished download job.
+func handleResumeDownload(client *wsClient, id string) {
+	m, err := loadJobManifest(id)
+	if err != nil {
+		sendError(client, err.Error())
+		return
+	}
+	submitDownloadJob(client, m)
+}
 
-	// Validate the zoom range.
-	if req.MinZoom < 0 || req.MaxZoom > 19 || req.MinZoom > req.MaxZoom {
-		sendError(conn, "Invalid zoom range (must be 0-19, min <= max)")
+// handleDiscardDownload deletes the manifest of an unfinished download job.
+func handleDiscardDownload(client *wsClient, id string) {
+	if downloadJobs.isActive(id) {
+		sendError(client, fmt.Sprintf("Download job %s is still queued or running", id))
 		return
 	}
-	// Validate the polygons.
-	if len(req.Polygons) == 0 {
-		sendError(conn, "No polygons provided")
+	if _, err := loadJobManifest(id); err != nil {
+		sendError(client, err.Error())
 		return
 	}
+	removeJobManifest(id)
+	log.Printf("Discarded unfinished download job %s", id)
+}
 
-	// Get the list of tiles to download.
-	tilesToDownload := getTilesForPolygons(req.Polygons, req.MinZoom, req.MaxZoom)
-
-	// Start the tile download process.
-	downloadTiles(ctx, conn, tilesToDownload, req.MapStyle, styleCacheDir, req.ConvertTo8Bit)
+// submitDownloadJob queues a new or resumed download job for a WebSocket client.
+func submitDownloadJob(client *wsClient, m jobManifest) {
+	job, position, err := downloadJobs.submit(m, client.jobSender(m.ID), client)
+	if err != nil {
+		sendError(client, err.Error())
+		return
+	}
+	job.sendMessage("download_queued", map[string]int{"position": position})
+}
 
-	// If the download was not cancelled
-	if ctx.Err() == nil {
-		sendMessage(conn, "download_complete", nil)
+// validateDownloadRequest checks the zoom range, polygons, holes, refresh mode and source headers of a download request.
+// The zoom range must be within the zoom levels of the map source.
+func validateDownloadRequest(req DownloadRequest) error {
+	source := findMapSource(req.MapStyle)
+	if req.MinZoom < source.MinZoom || req.MaxZoom > source.maxZoom() || req.MinZoom > req.MaxZoom {
+		return fmt.Errorf("Invalid zoom range (must be %d-%d, min <= max)", source.MinZoom, source.maxZoom())
 	}
+	if len(req.Polygons) == 0 {
+		return fmt.Errorf("No polygons provided")
+	}
+	if len(req.Holes) > len(req.Polygons) {
+		return fmt.Errorf("Invalid holes (%d lists of holes for %d polygons)", len(req.Holes), len(req.Polygons))
+	}
+	// Report missing environment variables before every tile fails because of them.
+	if _, _, err := source.requestHeaders(); err != nil {
+		return fmt.Errorf("Invalid map source: %v", err)
+	}
+	return validateRefresh(req.Refresh, req.RefreshDays)
 }
 
-// handleStartWorldDownload starts a new download process for the entire world.
-func handleStartWorldDownload(conn *websocket.Conn, req WorldDownloadRequest) {
-	// Lock the mutex to ensure only one download runs at a time.
-	downloadingMutex.Lock()
-	if downloading {
-		sendError(conn, "Another download is already in progress.")
-		downloadingMutex.Unlock()
+// handleCancelDownload cancels a download job, or all download jobs of the client if no ID is given.
+func handleCancelDownload(client *wsClient, id string) {
+	if id == "" {
+		if downloadJobs.cancelOwner(client) == 0 {
+			sendError(client, "No download in progress.")
+		}
 		return
 	}
-	downloading = true
-	downloadingMutex.Unlock()
-
-	// Defer setting the downloading flag to false.
-	defer func() {
-		downloadingMutex.Lock()
-		downloading = false
-		downloadingMutex.Unlock()
-	}()
-
-	log.Printf("Starting world download, map style: %s", req.MapStyle)
-
-	// Create a new context to allow for cancellation.
-	var ctx context.Context
-	ctx, downloadCancel = context.WithCancel(context.Background())
-
-	// Get the style name and cache directory.
-	styleName := getStyleName(req.MapStyle)
-	styleCacheDir := getStyleCacheDir(styleName)
+	if err := downloadJobs.cancel(id); err != nil {
+		sendError(client, err.Error())
+	}
+}
 
-	// Get the list of tiles to download for the world.
-	tilesToDownload := getWorldTiles()
+// messageSender delivers progress messages of a download to a client.
+type messageSender func(msg WSMessage) error
 
-	// Start the tile download process.
-	downloadTiles(ctx, conn, tilesToDownload, req.MapStyle, styleCacheDir, req.ConvertTo8Bit)
+// wsClient is a WebSocket connection that can be written by several download jobs.
+type wsClient struct {
+	conn       *websocket.Conn
+	writeMutex sync.Mutex // Mutex to allow only one writer at a time.
+}
 
-	// If the download was not cancelled
-	if ctx.Err() == nil {
-		sendMessage(conn, "download_complete", nil)
-	}
+// writeJSON writes a message to the WebSocket connection.
+func (c *wsClient) writeJSON(msg WSMessage) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	return c.conn.WriteJSON(msg)
 }
 
-// handleCancelDownload cancels an ongoing download.
-func handleCancelDownload(conn *websocket.Conn) {
-	if downloadCancel != nil {
-		downloadCancel()
-		log.Printf("Download cancelled by user")
-		sendMessage(conn, "download_cancelled", nil)
+// jobSender returns a messageSender that writes the messages of a job to the WebSocket connection.
+func (c *wsClient) jobSender(jobID string) messageSender {
+	return func(msg WSMessage) error {
+		msg.JobID = jobID
+		return c.writeJSON(msg)
 	}
 }
 
 // downloadTiles downloads a list of tiles concurrently.
-func downloadTiles(ctx context.Context, conn *websocket.Conn, tilesToDownload []Tile, mapStyle, styleCacheDir string, convertTo8Bit bool) {
-	// Create a channel for WebSocket messages.
+// onDone is called with the index and result of every processed tile and may be nil.
+func downloadTiles(ctx context.Context, send messageSender, tilesToDownload []Tile, req DownloadRequest, store tileStore, onDone func(i int, tile Tile, status tileStatus)) {
+	// Get the configuration of the map source, e.g. subdomains and headers.
+	source := findMapSource(req.MapStyle)
+	refresh := newRefreshPolicy(req)
+	if source.UsagePolicy != "" {
+		log.Printf("Please respect the usage policy of the map source: %s", source.UsagePolicy)
+	}
+
+	// Create a channel for progress messages.
 	msgChan := make(chan WSMessage)
 	var writerWg sync.WaitGroup
 	writerWg.Add(1)
-	// Start a goroutine to send messages from the channel to the WebSocket connection.
+	// Start a goroutine to send messages from the channel to the client.
 	go func() {
 		defer writerWg.Done()
 		for msg := range msgChan {
-			if err := conn.WriteJSON(msg); err != nil {
-				log.Println("Error writing JSON to websocket:", err)
+			if err := send(msg); err != nil {
+				log.Println("Error sending progress message:", err)
+				// Keep draining the channel so the workers don't block.
+				for range msgChan {
+				}
 				return
 			}
 		}
@@ -368,37 +549,44 @@ func downloadTiles(ctx context.Context, conn *websocket.Conn, tilesToDownload []
 	// Send a message indicating the download has started.
 	msgChan <- WSMessage{Type: "download_started", Data: map[string]int{"total_tiles": len(tilesToDownload)}}
 
+	// All workers share the throttle, so a server that is overloaded slows down the whole job.
+	throttle := newThrottle(msgChan)
+
 	// Use a WaitGroup to wait for all download goroutines to finish.
 	var downloadWg sync.WaitGroup
-	tileChan := make(chan Tile)
+	tileChan := make(chan int)
 
 	// Start the download workers.
 	for i := 0; i < *maxWorkers; i++ {
 		downloadWg.Add(1)
 		go func() {
 			defer downloadWg.Done()
-			for tile := range tileChan {
+			for i := range tileChan {
 				select {
 				case <-ctx.Done(): // Check if the download has been cancelled.
 					return
 				default:
-					downloadTile(ctx, msgChan, tile, mapStyle, styleCacheDir, convertTo8Bit, *maxRetries)
+					tile := tilesToDownload[i]
+					status := downloadTile(ctx, msgChan, tile, source, store, req.ConvertTo8Bit, refresh, throttle, *maxRetries)
+					if onDone != nil {
+						onDone(i, tile, status)
+					}
 				}
 			}
 		}()
 	}
 
-	// Rate limit the download of tiles.
-	ticker := time.NewTicker(time.Second / time.Duration(*rateLimit))
-	defer ticker.Stop()
-
+	// Rate limit the download of tiles. The throttle slows down the whole job when the server asks for it.
 DownloadLoop:
-	for _, tile := range tilesToDownload {
+	for i := range tilesToDownload {
+		if !throttle.wait(ctx) {
+			break DownloadLoop
+		}
 		select {
 		case <-ctx.Done():
 			break DownloadLoop
-		case <-ticker.C:
-			tileChan <- tile
+		case <-time.After(throttle.interval(*rateLimit)):
+			tileChan <- i
 		}
 	}
 	close(tileChan)
@@ -408,76 +596,122 @@ DownloadLoop:
 	close(msgChan)
 	writerWg.Wait()
 
+	// Update the metadata of the tile store.
+	if err := store.Sync(); err != nil {
+		log.Printf("Error updating tile storage: %v", err)
+	}
+
 	// If the download was not cancelled, send a completion message.
 	if ctx.Err() == nil {
 		log.Printf("Download finished successfully")
-		sendMessage(conn, "tiles_downloaded", nil)
+		if err := send(WSMessage{Type: "tiles_downloaded"}); err != nil {
+			log.Println("Error sending message:", err)
+		}
 	} else {
 		log.Printf("Download failed or was cancelled")
 	}
 }
 
 // downloadTile downloads a single map tile.
-func downloadTile(ctx context.Context, msgChan chan<- WSMessage, tile Tile, mapStyle, styleCacheDir string, convertTo8Bit bool, maxRetries int) {
-	// Construct the path to the tile file.
-	tileDir := filepath.Join(styleCacheDir, fmt.Sprintf("%d/%d", tile.Z, tile.X))
-	tilePath := filepath.Join(tileDir, fmt.Sprintf("%d.png", tile.Y))
-
+// An existing tile is skipped unless the refresh policy says it is due, then it is revalidated or downloaded again.
+// Every request waits for the throttle of the job, which is updated with every response.
+func downloadTile(ctx context.Context, msgChan chan<- WSMessage, tile Tile, source MapSource, store tileStore, convertTo8Bit bool, refresh refreshPolicy, throttle *throttle, maxRetries int) tileStatus {
 	// Check if the tile already exists in the cache.
-	if _, err := os.Stat(tilePath); err == nil {
-		bounds := tileBounds(tile)
-		msgChan <- WSMessage{Type: "tile_skipped", Data: map[string]float64{
-			"west":  bounds.West,
-			"south": bounds.South,
-			"east":  bounds.East,
-			"north": bounds.North,
-		}}
-		return
+	exists := store.Has(tile)
+	var info tileInfo
+	if exists && refresh.mode != refreshSkip {
+		var err error
+		if info, err = store.Info(tile); err != nil {
+			log.Printf("Could not read cache information of tile %v: %v", tile, err)
+		}
+	}
+	if exists && !refresh.due(info, time.Now()) {
+		msgChan <- tileBoundsMessage("tile_skipped", tile)
+		return tileSkipped
 	}
+	// Tiles that the map source does not have are not requested again, unless all tiles are downloaded again.
+	if !exists && refresh.mode != refreshOverwrite && store.Missing(tile) {
+		msgChan <- tileBoundsMessage("tile_missing", tile)
+		return tileMissing
+	}
+	conditional := exists && refresh.conditional() && info.hasValidators()
 
 	// Construct the URL for the tile.
-	subdomain := []string{"a", "b", "c"}[rand.Intn(3)]
-	url := strings.ReplaceAll(mapStyle, "{s}", subdomain)
-	url = strings.ReplaceAll(url, "{z}", fmt.Sprintf("%d", tile.Z))
-	url = strings.ReplaceAll(url, "{x}", fmt.Sprintf("%d", tile.X))
-	url = strings.ReplaceAll(url, "{y}", fmt.Sprintf("%d", tile.Y))
+	url := source.tileURL(tile)
 
 	var err error
+	var reason string // Why the last attempt failed.
 	for attempt := 0; attempt < maxRetries; attempt++ {
-		select {
-		case <-ctx.Done(): // Check for cancellation.
-			return
-		default:
+		// Wait while the server throttles the job. This also checks for cancellation.
+		if !throttle.wait(ctx) {
+			return tileCancelled
 		}
 
 		var req *http.Request
 		req, err = http.NewRequestWithContext(ctx, "GET", url, nil)
 		if err != nil {
-			log.Printf("Error creating request for tile %v: %v. Retrying...", tile, err)
-			time.Sleep(time.Second * time.Duration(math.Pow(2, float64(attempt))))
-			continue
+			// An invalid URL does not get valid by retrying.
+			log.Printf("Error creating request for tile %v: %v", tile, err)
+			msgChan <- tileFailedMessage(tile, err.Error())
+			return tileFailed
 		}
 
 		// Set basic headers
 		req.Header.Set("User-Agent", *userAgent)
-		req.Header.Set("Accept", "image/*")
+		req.Header.Set("Accept", source.accept())
+		// Headers of the map source replace the basic headers.
+		if err := source.setRequestHeaders(req); err != nil {
+			log.Printf("Error setting the headers of tile %v: %v", tile, err)
+			msgChan <- tileFailedMessage(tile, err.Error())
+			return tileFailed
+		}
+		if conditional {
+			info.setConditionalHeaders(req)
+		}
 
 		// Add small random delay between requests (100-300ms)
 		time.Sleep(time.Millisecond * time.Duration(100+rand.Intn(200)))
 
-		resp, err := http.DefaultClient.Do(req)
+		resp, err := httpClient.Do(req)
 		if err != nil {
+			reason = err.Error()
 			log.Printf("Error downloading tile %v: %v. Retrying...", tile, err)
 			time.Sleep(time.Second * time.Duration(math.Pow(2, float64(attempt))))
 			continue
 		}
+		refusedFinally := throttle.record(resp)
+		source.storeCookies(resp)
+
+		// The stored tile is still up to date.
+		if resp.StatusCode == http.StatusNotModified && conditional {
+			if err := resp.Body.Close(); err != nil {
+				log.Printf("Could not close response body: %v", err)
+			}
+			if err := store.SetInfo(tile, info.revalidated(resp.Header, time.Now())); err != nil {
+				log.Printf("Error writing cache information of tile %v: %v", tile, err)
+			}
+			msgChan <- tileBoundsMessage("tile_skipped", tile)
+			return tileSkipped
+		}
 
 		if resp.StatusCode != http.StatusOK {
 			if err := resp.Body.Close(); err != nil {
 				log.Printf("Could not close response body: %v", err)
 			}
+			reason = fmt.Sprintf("HTTP status %d", resp.StatusCode)
+			if missingTileStatus(resp.StatusCode) {
+				return markTileMissing(msgChan, tile, store, exists, reason)
+			}
+			if permanentStatus(resp.StatusCode) || refusedFinally {
+				log.Printf("Unexpected status code %d for tile %v, not retrying", resp.StatusCode, tile)
+				msgChan <- tileFailedMessage(tile, reason)
+				return tileFailed
+			}
 			log.Printf("Unexpected status code %d for tile %v. Retrying...", resp.StatusCode, tile)
-			time.Sleep(time.Second * time.Duration(math.Pow(2, float64(attempt))))
+			// The throttle already delays the next attempt of throttled requests.
+			if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+				time.Sleep(time.Second * time.Duration(math.Pow(2, float64(attempt))))
+			}
 			continue
 		}
 
@@ -486,18 +720,29 @@ func downloadTile(ctx context.Context, msgChan chan<- WSMessage, tile Tile, mapS
 			log.Printf("Could not close response body: %v", err)
 		}
 		if err != nil {
+			reason = err.Error()
 			log.Printf("Error reading tile body for tile %v: %v. Retrying...", tile, err)
 			time.Sleep(time.Second * time.Duration(math.Pow(2, float64(attempt))))
 			continue
 		}
 
-		if err := os.MkdirAll(tileDir, 0755); err != nil {
-			log.Printf("Error creating tile directory for tile %v: %v", tile, err)
-			return // No point in retrying if we can't create the directory
+		// Reject error pages, placeholders and broken images instead of storing them.
+		contentType := resp.Header.Get("Content-Type")
+		format := responseTileFormat(contentType, body, source.Format)
+		if err := checkTileResponse(contentType, body, format, source); err != nil {
+			reason = err.Error()
+			// A placeholder is the way of the map source to say that it has no such tile.
+			var problem *tileProblem
+			if errors.As(err, &problem) && problem.Kind == tileProblemPlaceholder {
+				return markTileMissing(msgChan, tile, store, exists, reason)
+			}
+			log.Printf("Invalid tile %v: %v. Retrying...", tile, err)
+			time.Sleep(time.Second * time.Duration(math.Pow(2, float64(attempt))))
+			continue
 		}
 
 		// Convert the image to 8-bit PNG if requested.
-		if convertTo8Bit {
+		if convertTo8Bit && format != "pbf" {
 			img, _, err := image.Decode(bytes.NewReader(body))
 			if err == nil {
 				paletted := image.NewPaletted(img.Bounds(), color.Palette{})
@@ -505,60 +750,97 @@ func downloadTile(ctx context.Context, msgChan chan<- WSMessage, tile Tile, mapS
 				var buf bytes.Buffer
 				if err := png.Encode(&buf, paletted); err == nil {
 					body = buf.Bytes()
+					format = "png"
 				}
 			}
 		}
 
-		if err := os.WriteFile(tilePath, body, 0644); err != nil {
+		if err := store.Put(tile, body, format); err != nil {
 			log.Printf("Error writing tile %v: %v", tile, err)
-			return // No point in retrying if we can't write the file
+			msgChan <- tileFailedMessage(tile, fmt.Sprintf("could not write the tile: %v", err))
+			return tileFailed // No point in retrying if we can't write the tile
 		}
+		if err := store.SetInfo(tile, responseTileInfo(resp.Header, time.Now())); err != nil {
+			log.Printf("Error writing cache information of tile %v: %v", tile, err)
+		}
+
+		msgChan <- tileBoundsMessage("tile_downloaded", tile)
+		return tileDownloaded // Success!
+	}
 
-		bounds := tileBounds(tile)
-		msgChan <- WSMessage{Type: "tile_downloaded", Data: map[string]float64{
-			"west":  bounds.West,
-			"south": bounds.South,
-			"east":  bounds.East,
-			"north": bounds.North,
-		}}
-		return // Success!
+	// A cancelled request is not a failed tile.
+	if ctx.Err() != nil {
+		return tileCancelled
 	}
 
 	// If all retries fail, send a failure message.
-	log.Printf("Failed to download tile %v after %d attempts.", tile, maxRetries)
-	msgChan <- WSMessage{Type: "tile_failed", Data: map[string]string{"tile": fmt.Sprintf("%d/%d/%d", tile.Z, tile.X, tile.Y)}}
+	log.Printf("Failed to download tile %v after %d attempts: %s", tile, maxRetries, reason)
+	msgChan <- tileFailedMessage(tile, reason)
+	return tileFailed
+}
+
+// missingTileStatus checks if a response status means that the map source does not have a tile.
+// Some servers answer 204 No Content instead of 404 Not Found.
+func missingTileStatus(status int) bool {
+	return status == http.StatusNoContent || status == http.StatusNotFound || status == http.StatusGone
+}
+
+// permanentStatus checks if a response status is an error that retrying the request does not fix.
+// Servers that throttle clients also answer 403, 408 and 429, so these are retried
+// until the throttle decides that a server keeps refusing the requests.
+func permanentStatus(status int) bool {
+	switch status {
+	case http.StatusForbidden, http.StatusRequestTimeout, http.StatusTooEarly, http.StatusTooManyRequests:
+		return false
+	}
+	return (status >= 400 && status < 500) || status == http.StatusNotImplemented
+}
+
+// markTileMissing records that the map source does not have a tile and sends a progress message.
+// A stored tile is kept, so refreshing never removes tiles that the map source removed.
+func markTileMissing(msgChan chan<- WSMessage, tile Tile, store tileStore, exists bool, reason string) tileStatus {
+	log.Printf("Tile %v does not exist on the map source: %s", tile, reason)
+	if !exists {
+		if err := store.SetMissing(tile); err != nil {
+			log.Printf("Error recording missing tile %v: %v", tile, err)
+		}
+	}
+	msgChan <- tileBoundsMessage("tile_missing", tile)
+	return tileMissing
+}
+
+// tileBoundsMessage returns a progress message with the bounds of a tile.
+func tileBoundsMessage(msgType string, tile Tile) WSMessage {
+	bounds := tileBounds(tile)
+	return WSMessage{Type: msgType, Data: map[string]float64{
+		"west":  bounds.West,
+		"south": bounds.South,
+		"east":  bounds.East,
+		"north": bounds.North,
+	}}
+}
+
+// tileFailedMessage returns a progress message for a tile that could not be downloaded and why.
+func tileFailedMessage(tile Tile, reason string) WSMessage {
+	return WSMessage{Type: "tile_failed", Data: map[string]string{"tile": tileKey(tile), "reason": reason}}
 }
 
 // getTilesForPolygons calculates the tiles needed to cover the given polygons.
-func getTilesForPolygons(polygonsData [][]LatLng, minZoom, maxZoom int) []Tile {
+// Tiles that are completely within a hole of a polygon are left out, unless another polygon covers them.
+func getTilesForPolygons(polygons []Polygon, minZoom, maxZoom int) []Tile {
 	var allTiles []Tile
 	tileMap := make(map[Tile]bool)
 
-	for _, polyData := range polygonsData {
-		if len(polyData) < 3 {
+	for _, polygon := range polygons {
+		if len(polygon.Outer) < 3 {
 			continue
 		}
 
-		minLat, minLon := 90.0, 180.0
-		maxLat, maxLon := -90.0, -180.0
-		for _, p := range polyData {
-			if p.Lat < minLat {
-				minLat = p.Lat
-			}
-			if p.Lat > maxLat {
-				maxLat = p.Lat
-			}
-			if p.Lng < minLon {
-				minLon = p.Lng
-			}
-			if p.Lng > maxLon {
-				maxLon = p.Lng
-			}
-		}
+		polyBounds := polygonBounds(polygon.Outer)
 
 		for z := minZoom; z <= maxZoom; z++ {
-			tlx, tly := latLonToTile(maxLat, minLon, uint32(z))
-			brx, bry := latLonToTile(minLat, maxLon, uint32(z))
+			tlx, tly := latLonToTile(polyBounds.North, polyBounds.West, uint32(z))
+			brx, bry := latLonToTile(polyBounds.South, polyBounds.East, uint32(z))
 
 			for x := tlx; x <= brx; x++ {
 				for y := tly; y <= bry; y++ {
@@ -567,34 +849,7 @@ func getTilesForPolygons(polygonsData [][]LatLng, minZoom, maxZoom int) []Tile {
 						continue
 					}
 
-					bounds := tileBounds(tile)
-
-					// Check if the tile is completely inside the polygon
-					if polygonContains(polyData, LatLng{Lat: bounds.North, Lng: bounds.West}) &&
-						polygonContains(polyData, LatLng{Lat: bounds.North, Lng: bounds.East}) &&
-						polygonContains(polyData, LatLng{Lat: bounds.South, Lng: bounds.West}) &&
-						polygonContains(polyData, LatLng{Lat: bounds.South, Lng: bounds.East}) {
-						allTiles = append(allTiles, tile)
-						tileMap[tile] = true
-						continue
-					}
-
-					// Check if the polygon is completely inside the tile
-					polyInTile := true
-					for _, p := range polyData {
-						if !tileContains(bounds, p) {
-							polyInTile = false
-							break
-						}
-					}
-					if polyInTile {
-						allTiles = append(allTiles, tile)
-						tileMap[tile] = true
-						continue
-					}
-
-					// Check for intersection
-					if polygonIntersects(polyData, bounds) {
+					if polygon.coversTile(tileBounds(tile)) {
 						allTiles = append(allTiles, tile)
 						tileMap[tile] = true
 					}
@@ -606,6 +861,86 @@ func getTilesForPolygons(polygonsData [][]LatLng, minZoom, maxZoom int) []Tile {
 	return allTiles
 }
 
+// polygonBounds calculates the bounding box of a polygon.
+func polygonBounds(polyData []LatLng) BoundingBox {
+	bounds := BoundingBox{North: -90, South: 90, East: -180, West: 180}
+	for _, p := range polyData {
+		bounds.South = math.Min(bounds.South, p.Lat)
+		bounds.North = math.Max(bounds.North, p.Lat)
+		bounds.West = math.Min(bounds.West, p.Lng)
+		bounds.East = math.Max(bounds.East, p.Lng)
+	}
+	return bounds
+}
+
+// coversTile checks if the polygon covers any part of a tile outside of its holes.
+func (p Polygon) coversTile(bounds BoundingBox) bool {
+	if len(p.Outer) < 3 || !polygonCoversTile(p.Outer, bounds) {
+		return false
+	}
+	for _, hole := range p.Holes {
+		if len(hole) >= 3 && ringContainsTile(hole, bounds) {
+			return false
+		}
+	}
+	return true
+}
+
+// ringContainsTile checks if a ring covers a whole tile.
+// A tile that the ring only touches or cuts is not contained, so a hole never removes a tile that is partly in the area.
+func ringContainsTile(ring []LatLng, bounds BoundingBox) bool {
+	corners := []LatLng{
+		{Lat: bounds.North, Lng: bounds.West},
+		{Lat: bounds.North, Lng: bounds.East},
+		{Lat: bounds.South, Lng: bounds.East},
+		{Lat: bounds.South, Lng: bounds.West},
+	}
+	for _, corner := range corners {
+		if !polygonContains(ring, corner) {
+			return false
+		}
+	}
+	// A concave ring can contain all corners of a tile and still cut through it.
+	for i, p1 := range ring {
+		if tileContains(bounds, p1) {
+			return false
+		}
+		p2 := ring[(i+1)%len(ring)]
+		for j, c1 := range corners {
+			if lineIntersects(p1, p2, c1, corners[(j+1)%len(corners)]) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// polygonCoversTile checks if a polygon covers any part of a tile.
+func polygonCoversTile(polyData []LatLng, bounds BoundingBox) bool {
+	// Check if the tile is completely inside the polygon
+	if polygonContains(polyData, LatLng{Lat: bounds.North, Lng: bounds.West}) &&
+		polygonContains(polyData, LatLng{Lat: bounds.North, Lng: bounds.East}) &&
+		polygonContains(polyData, LatLng{Lat: bounds.South, Lng: bounds.West}) &&
+		polygonContains(polyData, LatLng{Lat: bounds.South, Lng: bounds.East}) {
+		return true
+	}
+
+	// Check if the polygon is completely inside the tile
+	polyInTile := true
+	for _, p := range polyData {
+		if !tileContains(bounds, p) {
+			polyInTile = false
+			break
+		}
+	}
+	if polyInTile {
+		return true
+	}
+
+	// Check for intersection
+	return polygonIntersects(polyData, bounds)
+}
+
 // tileContains checks if a tile contains a point.
 func tileContains(bounds BoundingBox, point LatLng) bool {
 	return point.Lat <= bounds.North && point.Lat >= bounds.South && point.Lng >= bounds.West && point.Lng <= bounds.East
@@ -715,35 +1050,49 @@ func serveTile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	styleName := parts[0]
-	z := parts[1]
-	x := parts[2]
-	y := strings.TrimSuffix(parts[3], ".png")
+	z, zErr := strToUint32(parts[1])
+	x, xErr := strToUint32(parts[2])
+	// The extension is ignored, so a tile is served in the format it was stored in.
+	yPart, _, _ := strings.Cut(parts[3], ".")
+	y, yErr := strToUint32(yPart)
+	if zErr != nil || xErr != nil || yErr != nil {
+		http.NotFound(w, r)
+		return
+	}
 
-	tilePath := filepath.Join(*cacheDir, sanitizeStyleName(styleName), z, x, y+".png")
-	http.ServeFile(w, r, tilePath)
+	store, err := getTileStore(styleName, false)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error opening tile storage: %v", err), http.StatusInternalServerError)
+		return
+	}
+	data, format, err := store.Get(Tile{X: x, Y: y, Z: z})
+	if errors.Is(err, fs.ErrNotExist) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error reading tile: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", tileFormatContentType(format))
+	if format == "pbf" && sniffTileFormat(data) == "pbf" {
+		w.Header().Set("Content-Encoding", "gzip")
+	}
+	http.ServeContent(w, r, yPart+"."+format, time.Time{}, bytes.NewReader(data))
 }
 
 // getCachedTiles returns a list of cached tiles for a specific map style.
 func getCachedTiles(w http.ResponseWriter, r *http.Request) {
 	styleName := strings.TrimPrefix(r.URL.Path, "/get_cached_tiles/")
-	styleCacheDir := getStyleCacheDir(styleName)
+	store, err := getTileStore(styleName, false)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error opening tile storage: %v", err), http.StatusInternalServerError)
+		return
+	}
 
 	var cachedTiles [][3]uint32
-	err := filepath.Walk(styleCacheDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if !info.IsDir() && strings.HasSuffix(info.Name(), ".png") {
-			parts := strings.Split(strings.TrimSuffix(path, ".png"), string(filepath.Separator))
-			if len(parts) >= 4 {
-				z, zErr := strToUint32(parts[len(parts)-3])
-				x, xErr := strToUint32(parts[len(parts)-2])
-				y, yErr := strToUint32(parts[len(parts)-1])
-				if zErr == nil && xErr == nil && yErr == nil {
-					cachedTiles = append(cachedTiles, [3]uint32{z, x, y})
-				}
-			}
-		}
+	err = store.Walk(func(tile Tile) error {
+		cachedTiles = append(cachedTiles, [3]uint32{tile.Z, tile.X, tile.Y})
 		return nil
 	})
 
@@ -760,8 +1109,9 @@ func getCachedTiles(w http.ResponseWriter, r *http.Request) {
 
 // getStyleName returns the name of the map style for a given URL.
 func getStyleName(mapStyleURL string) string {
-	for name, url := range mapSources {
-		if url == mapStyleURL {
+	names, sources := listMapSources()
+	for _, name := range names {
+		if sources[name].withDefaults().URL == mapStyleURL {
 			return name
 		}
 	}
@@ -782,16 +1132,16 @@ func sanitizeStyleName(styleName string) string {
 }
 
 // sendMessage sends a WebSocket message.
-func sendMessage(conn *websocket.Conn, msgType string, data interface{}) {
+func sendMessage(client *wsClient, msgType string, data interface{}) {
 	msg := WSMessage{Type: msgType, Data: data}
-	if err := conn.WriteJSON(msg); err != nil {
+	if err := client.writeJSON(msg); err != nil {
 		log.Println("Error sending message:", err)
 	}
 }
 
 // sendError sends an error message over the WebSocket connection.
-func sendError(conn *websocket.Conn, message string) {
-	sendMessage(conn, "error", map[string]string{"message": message})
+func sendError(client *wsClient, message string) {
+	sendMessage(client, "error", map[string]string{"message": message})
 }
 
 // strToUint32 converts a string to a uint32.
@@ -801,12 +1151,18 @@ func strToUint32(s string) (uint32, error) {
 	return i, err
 }
 
+// maxMercatorLatitude is the northernmost and southernmost latitude covered by Web Mercator tiles.
+const maxMercatorLatitude = 85.05112878
+
 // latLonToTile converts latitude and longitude to tile coordinates.
+// Coordinates beyond the Web Mercator limits are clamped to the outermost tiles.
 func latLonToTile(lat, lon float64, zoom uint32) (x, y uint32) {
+	lat = max(min(lat, maxMercatorLatitude), -maxMercatorLatitude)
 	latRad := lat * math.Pi / 180
 	n := math.Pow(2, float64(zoom))
-	x = uint32(n * ((lon + 180) / 360))
-	y = uint32(n * (1 - (math.Log(math.Tan(latRad)+1/math.Cos(latRad)) / math.Pi)) / 2)
+	last := n - 1
+	x = uint32(min(n*((lon+180)/360), last))
+	y = uint32(min(n*(1-(math.Log(math.Tan(latRad)+1/math.Cos(latRad))/math.Pi))/2, last))
 	return
 }
 
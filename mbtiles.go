@@ -0,0 +1,452 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite" // SQLite driver for MBTiles files, written in Go so it works in builds without cgo.
+)
+
+// mbtilesSchema creates the tables of the MBTiles 1.3 specification.
+const mbtilesSchema = `
+CREATE TABLE IF NOT EXISTS metadata (name TEXT, value TEXT);
+CREATE UNIQUE INDEX IF NOT EXISTS name ON metadata (name);
+CREATE TABLE IF NOT EXISTS tiles (zoom_level INTEGER, tile_column INTEGER, tile_row INTEGER, tile_data BLOB);
+CREATE UNIQUE INDEX IF NOT EXISTS tile_index ON tiles (zoom_level, tile_column, tile_row);
+`
+
+// mbtilesInfoSchema creates the tables for the cache information of downloaded tiles and the tiles the map source does not have.
+// They are not part of the MBTiles specification and ignored by other applications.
+const mbtilesInfoSchema = `
+CREATE TABLE IF NOT EXISTS tile_info (zoom_level INTEGER, tile_column INTEGER, tile_row INTEGER, fetched INTEGER, expires INTEGER, etag TEXT, last_modified TEXT);
+CREATE UNIQUE INDEX IF NOT EXISTS tile_info_index ON tile_info (zoom_level, tile_column, tile_row);
+CREATE TABLE IF NOT EXISTS missing_tiles (zoom_level INTEGER, tile_column INTEGER, tile_row INTEGER);
+CREATE UNIQUE INDEX IF NOT EXISTS missing_tiles_index ON missing_tiles (zoom_level, tile_column, tile_row);
+`
+
+// openMBTiles opens an MBTiles file and creates its tables if necessary.
+func openMBTiles(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(mbtilesSchema); err != nil {
+		if err := db.Close(); err != nil {
+			log.Printf("Could not close MBTiles file: %v", err)
+		}
+		return nil, fmt.Errorf("could not create MBTiles tables: %w", err)
+	}
+	return db, nil
+}
+
+// mbtilesRow returns the TMS row of a tile, which counts from the south instead of the north.
+func mbtilesRow(tile Tile) uint32 {
+	return (1 << tile.Z) - 1 - tile.Y
+}
+
+// writeMBTilesMetadata stores the metadata of an MBTiles file.
+func writeMBTilesMetadata(db *sql.DB, metadata map[string]string) error {
+	for name, value := range metadata {
+		if _, err := db.Exec("INSERT OR REPLACE INTO metadata (name, value) VALUES (?, ?)", name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mbtilesStore stores the tiles of a map style in an MBTiles file.
+type mbtilesStore struct {
+	path string
+	db   *sql.DB
+
+	formatMutex sync.Mutex // Mutex to protect access to the format.
+	format      string     // The format of the tiles from the metadata, used for tiles of an unknown format.
+}
+
+// formatSampleSize is the number of tiles whose format is checked to update the format in the metadata.
+const formatSampleSize = 100
+
+// openMBTilesStore opens or creates the MBTiles file of a map style.
+func openMBTilesStore(path, styleName string) (*mbtilesStore, error) {
+	db, err := openMBTiles(path + "?_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows only one writer, so the download workers share a single connection.
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(mbtilesInfoSchema); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("could not create MBTiles tables: %w", err)
+	}
+
+	// Describe a new file so it can be used by other applications right away.
+	metadata := map[string]string{"name": styleName, "type": "baselayer", "version": "1.1", "format": "png"}
+	for name, value := range metadata {
+		if _, err := db.Exec("INSERT OR IGNORE INTO metadata (name, value) VALUES (?, ?)", name, value); err != nil {
+			_ = db.Close()
+			return nil, fmt.Errorf("could not write MBTiles metadata: %w", err)
+		}
+	}
+	var format string
+	if err := db.QueryRow("SELECT value FROM metadata WHERE name = 'format'").Scan(&format); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("could not read MBTiles metadata: %w", err)
+	}
+	return &mbtilesStore{path: path, db: db, format: format}, nil
+}
+
+// Has checks if a tile row exists.
+func (s *mbtilesStore) Has(tile Tile) bool {
+	var exists int
+	err := s.db.QueryRow("SELECT 1 FROM tiles WHERE zoom_level = ? AND tile_column = ? AND tile_row = ?",
+		tile.Z, tile.X, mbtilesRow(tile)).Scan(&exists)
+	return err == nil
+}
+
+// Get reads the data of a tile row. The format is detected from the data,
+// as a map source may change its format and the tiles of a file are not all of the format in the metadata.
+func (s *mbtilesStore) Get(tile Tile) ([]byte, string, error) {
+	var data []byte
+	err := s.db.QueryRow("SELECT tile_data FROM tiles WHERE zoom_level = ? AND tile_column = ? AND tile_row = ?",
+		tile.Z, tile.X, mbtilesRow(tile)).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, "", fs.ErrNotExist
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if format := sniffTileFormat(data); format != "" {
+		return data, format, nil
+	}
+	s.formatMutex.Lock()
+	defer s.formatMutex.Unlock()
+	return data, s.format, nil
+}
+
+// Put inserts or replaces a tile row and removes its missing marker.
+// The format is not stored, Get detects it from the data.
+func (s *mbtilesStore) Put(tile Tile, data []byte, format string) error {
+	if _, err := s.db.Exec("INSERT OR REPLACE INTO tiles (zoom_level, tile_column, tile_row, tile_data) VALUES (?, ?, ?, ?)",
+		tile.Z, tile.X, mbtilesRow(tile), data); err != nil {
+		return err
+	}
+	_, err := s.db.Exec("DELETE FROM missing_tiles WHERE zoom_level = ? AND tile_column = ? AND tile_row = ?",
+		tile.Z, tile.X, mbtilesRow(tile))
+	return err
+}
+
+// Info returns the cache information of a tile row.
+// Tiles downloaded without cache information have a zero download time.
+func (s *mbtilesStore) Info(tile Tile) (tileInfo, error) {
+	if !s.Has(tile) {
+		return tileInfo{}, fs.ErrNotExist
+	}
+	var fetched, expires sql.NullInt64
+	var etag, lastModified sql.NullString
+	err := s.db.QueryRow("SELECT fetched, expires, etag, last_modified FROM tile_info WHERE zoom_level = ? AND tile_column = ? AND tile_row = ?",
+		tile.Z, tile.X, mbtilesRow(tile)).Scan(&fetched, &expires, &etag, &lastModified)
+	if errors.Is(err, sql.ErrNoRows) {
+		return tileInfo{}, nil
+	}
+	if err != nil {
+		return tileInfo{}, err
+	}
+	info := tileInfo{ETag: etag.String, LastModified: lastModified.String}
+	if fetched.Valid {
+		info.Fetched = time.Unix(fetched.Int64, 0)
+	}
+	if expires.Valid {
+		info.Expires = time.Unix(expires.Int64, 0)
+	}
+	return info, nil
+}
+
+// SetInfo inserts or replaces the cache information of a tile row.
+func (s *mbtilesStore) SetInfo(tile Tile, info tileInfo) error {
+	var expires sql.NullInt64
+	if !info.Expires.IsZero() {
+		expires = sql.NullInt64{Int64: info.Expires.Unix(), Valid: true}
+	}
+	_, err := s.db.Exec("INSERT OR REPLACE INTO tile_info (zoom_level, tile_column, tile_row, fetched, expires, etag, last_modified) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		tile.Z, tile.X, mbtilesRow(tile), info.Fetched.Unix(), expires, info.ETag, info.LastModified)
+	return err
+}
+
+// Missing checks if a missing tile row exists.
+func (s *mbtilesStore) Missing(tile Tile) bool {
+	var exists int
+	err := s.db.QueryRow("SELECT 1 FROM missing_tiles WHERE zoom_level = ? AND tile_column = ? AND tile_row = ?",
+		tile.Z, tile.X, mbtilesRow(tile)).Scan(&exists)
+	return err == nil
+}
+
+// SetMissing inserts a missing tile row.
+func (s *mbtilesStore) SetMissing(tile Tile) error {
+	_, err := s.db.Exec("INSERT OR IGNORE INTO missing_tiles (zoom_level, tile_column, tile_row) VALUES (?, ?, ?)",
+		tile.Z, tile.X, mbtilesRow(tile))
+	return err
+}
+
+// Delete removes a tile row, its cache information and its missing marker.
+func (s *mbtilesStore) Delete(tile Tile) error {
+	for _, table := range []string{"tiles", "tile_info", "missing_tiles"} {
+		if _, err := s.db.Exec("DELETE FROM "+table+" WHERE zoom_level = ? AND tile_column = ? AND tile_row = ?",
+			tile.Z, tile.X, mbtilesRow(tile)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Walk calls fn for every tile row.
+func (s *mbtilesStore) Walk(fn func(tile Tile) error) error {
+	return s.walkTable("tiles", fn)
+}
+
+// WalkMissing calls fn for every missing tile row.
+func (s *mbtilesStore) WalkMissing(fn func(tile Tile) error) error {
+	return s.walkTable("missing_tiles", fn)
+}
+
+// walkTable calls fn for every row of a table with tile coordinates.
+func (s *mbtilesStore) walkTable(table string, fn func(tile Tile) error) error {
+	// Collect the tiles first, so fn can use the store while walking.
+	rows, err := s.db.Query("SELECT zoom_level, tile_column, tile_row FROM " + table)
+	if err != nil {
+		return err
+	}
+	var tiles []Tile
+	for rows.Next() {
+		var tile Tile
+		var row uint32
+		if err := rows.Scan(&tile.Z, &tile.X, &row); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		tile.Y = (1 << tile.Z) - 1 - row
+		tiles = append(tiles, tile)
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, tile := range tiles {
+		if err := fn(tile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sync updates the bounds, zoom levels and format in the metadata from the stored tiles.
+func (s *mbtilesStore) Sync() error {
+	var minZoom, maxZoom sql.NullInt64
+	if err := s.db.QueryRow("SELECT MIN(zoom_level), MAX(zoom_level) FROM tiles").Scan(&minZoom, &maxZoom); err != nil {
+		return err
+	}
+	if !maxZoom.Valid {
+		return nil
+	}
+
+	// The tiles of the highest zoom level give the most accurate bounds.
+	var minX, maxX, minRow, maxRow uint32
+	if err := s.db.QueryRow("SELECT MIN(tile_column), MAX(tile_column), MIN(tile_row), MAX(tile_row) FROM tiles WHERE zoom_level = ?",
+		maxZoom.Int64).Scan(&minX, &maxX, &minRow, &maxRow); err != nil {
+		return err
+	}
+	format, err := s.sampleFormat()
+	if err != nil {
+		return err
+	}
+	z := uint32(maxZoom.Int64)
+	northWest := tileBounds(Tile{X: minX, Y: (1 << z) - 1 - maxRow, Z: z})
+	southEast := tileBounds(Tile{X: maxX, Y: (1 << z) - 1 - minRow, Z: z})
+
+	return writeMBTilesMetadata(s.db, map[string]string{
+		"format": format,
+		"bounds": fmt.Sprintf("%s,%s,%s,%s",
+			formatCoordinate(northWest.West), formatCoordinate(southEast.South),
+			formatCoordinate(southEast.East), formatCoordinate(northWest.North)),
+		"minzoom": strconv.FormatInt(minZoom.Int64, 10),
+		"maxzoom": strconv.FormatInt(maxZoom.Int64, 10),
+	})
+}
+
+// sampleFormat returns the most common format of a random sample of the tiles and makes it the format of the store.
+// The format of the metadata is kept if no tile of the sample has a known format.
+func (s *mbtilesStore) sampleFormat() (string, error) {
+	rows, err := s.db.Query("SELECT tile_data FROM tiles WHERE rowid IN (SELECT rowid FROM tiles ORDER BY RANDOM() LIMIT ?)", formatSampleSize)
+	if err != nil {
+		return "", err
+	}
+	counts := map[string]int{}
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			_ = rows.Close()
+			return "", err
+		}
+		if format := sniffTileFormat(data); format != "" {
+			counts[format]++
+		}
+	}
+	if err := rows.Close(); err != nil {
+		return "", err
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+
+	var sampled string
+	var most int
+	for format, count := range counts {
+		// Ties are broken by name, so the format does not change between syncs of the same tiles.
+		if count > most || count == most && format < sampled {
+			sampled = format
+			most = count
+		}
+	}
+	s.formatMutex.Lock()
+	defer s.formatMutex.Unlock()
+	if sampled != "" {
+		s.format = sampled
+	}
+	return s.format, nil
+}
+
+// Close closes the MBTiles file.
+func (s *mbtilesStore) Close() error {
+	return s.db.Close()
+}
+
+// exportMBTiles packs the tiles of a tile store into an MBTiles file and returns the number of tiles.
+// The file is written to a temporary file and renamed, so an existing output file is replaced instead of merged
+// and a failed export leaves it untouched.
+func exportMBTiles(src tileStore, output string, opts exportOptions) (int, error) {
+	if store, ok := src.(*mbtilesStore); ok && sameFile(store.path, output) {
+		return 0, fmt.Errorf("output file %s is the MBTiles file of the map style", output)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(output), filepath.Base(output)+".*"+tempFileSuffix)
+	if err != nil {
+		return 0, err
+	}
+	tmpPath := tmp.Name()
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+	count, err := writeMBTiles(src, tmpPath, opts)
+	if err == nil {
+		// CreateTemp creates the file only readable by the owner.
+		err = os.Chmod(tmpPath, 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, output)
+	}
+	if err != nil {
+		if removeErr := os.Remove(tmpPath); removeErr != nil && !errors.Is(removeErr, fs.ErrNotExist) {
+			log.Printf("Could not remove temporary file: %v", removeErr)
+		}
+		return 0, err
+	}
+	return count, nil
+}
+
+// writeMBTiles writes the tiles of a tile store into a new MBTiles file and returns the number of tiles.
+func writeMBTiles(src tileStore, path string, opts exportOptions) (count int, err error) {
+	db, err := openMBTiles(path)
+	if err != nil {
+		return 0, err
+	}
+	// The file must be complete before it is renamed, so an error closing it fails the export.
+	defer func() {
+		if closeErr := db.Close(); closeErr != nil && err == nil {
+			count, err = 0, fmt.Errorf("could not close MBTiles file: %w", closeErr)
+		}
+	}()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	stmt, err := tx.Prepare("INSERT OR REPLACE INTO tiles (zoom_level, tile_column, tile_row, tile_data) VALUES (?, ?, ?, ?)")
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+
+	summary := newExportSummary()
+	err = src.Walk(func(tile Tile) error {
+		if !opts.includes(tile) {
+			return nil
+		}
+		data, format, err := src.Get(tile)
+		if err != nil {
+			return err
+		}
+		if _, err := stmt.Exec(tile.Z, tile.X, mbtilesRow(tile), data); err != nil {
+			return err
+		}
+		summary.add(tile, data, format)
+		return nil
+	})
+	if err := stmt.Close(); err != nil {
+		log.Printf("Could not close statement: %v", err)
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	if summary.count == 0 {
+		return 0, fmt.Errorf("no cached tiles found for the selected area and zoom levels")
+	}
+
+	metadata := map[string]string{
+		"name":    opts.Name,
+		"type":    "baselayer",
+		"version": "1.1",
+		"format":  summary.format,
+		"bounds": fmt.Sprintf("%s,%s,%s,%s",
+			formatCoordinate(summary.bounds.West), formatCoordinate(summary.bounds.South),
+			formatCoordinate(summary.bounds.East), formatCoordinate(summary.bounds.North)),
+		"center": fmt.Sprintf("%s,%s,%d",
+			formatCoordinate((summary.bounds.West+summary.bounds.East)/2),
+			formatCoordinate((summary.bounds.South+summary.bounds.North)/2), summary.minZoom),
+		"minzoom": strconv.Itoa(int(summary.minZoom)),
+		"maxzoom": strconv.Itoa(int(summary.maxZoom)),
+	}
+	if opts.Attribution != "" {
+		metadata["attribution"] = opts.Attribution
+	}
+	if err := writeMBTilesMetadata(db, metadata); err != nil {
+		return 0, fmt.Errorf("could not write MBTiles metadata: %w", err)
+	}
+	return summary.count, nil
+}
+
+// sameFile checks if two paths refer to the same file.
+func sameFile(a, b string) bool {
+	infoA, errA := os.Stat(a)
+	infoB, errB := os.Stat(b)
+	return errA == nil && errB == nil && os.SameFile(infoA, infoB)
+}
+
+// formatCoordinate formats a coordinate with a precision of about one meter.
+func formatCoordinate(f float64) string {
+	return strconv.FormatFloat(math.Round(f*1e6)/1e6, 'f', -1, 64)
+}
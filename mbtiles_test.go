@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"image/jpeg"
+	"image/png"
+	"path/filepath"
+	"testing"
+)
+
+// encodeTestTile returns a synthetic tile encoded as PNG or JPEG.
+func encodeTestTile(t *testing.T, tile Tile, format string) []byte {
+	t.Helper()
+	img := mockTileImage(tile, 256)
+	var buf bytes.Buffer
+	var err error
+	if format == "jpg" {
+		err = jpeg.Encode(&buf, img, nil)
+	} else {
+		err = png.Encode(&buf, img)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestMBTilesStoreMixedFormats(t *testing.T) {
+	store, err := openMBTilesStore(filepath.Join(t.TempDir(), "test.mbtiles"), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	tiles := []struct {
+		tile   Tile
+		format string
+	}{
+		{Tile{Z: 1, X: 0, Y: 0}, "png"},
+		{Tile{Z: 1, X: 1, Y: 0}, "png"},
+		{Tile{Z: 1, X: 0, Y: 1}, "png"},
+		{Tile{Z: 1, X: 1, Y: 1}, "jpg"},
+	}
+	for _, tt := range tiles {
+		if err := store.Put(tt.tile, encodeTestTile(t, tt.tile, tt.format), tt.format); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The format of every tile is its own, not the one of the last stored tile.
+	for _, tt := range tiles {
+		_, format, err := store.Get(tt.tile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if format != tt.format {
+			t.Errorf("tile %s: got format %q, want %q", tileKey(tt.tile), format, tt.format)
+		}
+	}
+
+	// The metadata describes the format of most tiles.
+	if err := store.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	var format string
+	if err := store.db.QueryRow("SELECT value FROM metadata WHERE name = 'format'").Scan(&format); err != nil {
+		t.Fatal(err)
+	}
+	if format != "png" {
+		t.Errorf("got metadata format %q, want png", format)
+	}
+}
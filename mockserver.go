@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// mockServer serves synthetic tiles with the tile coordinates drawn on them.
+type mockServer struct {
+	latency      time.Duration // The delay before every response.
+	errorRate    float64       // The fraction of requests answered with 500 Internal Server Error.
+	throttleRate float64       // The fraction of requests answered with 429 Too Many Requests.
+	retryAfter   int           // The Retry-After header of 429 responses in seconds.
+	maxZoom      int           // The highest zoom level with tiles.
+	tileSize     int           // The width and height of the tiles in pixels.
+}
+
+// runMockServerCommand serves synthetic tiles for testing downloads without internet access and returns the exit code.
+func runMockServerCommand(args []string) int {
+	fs := flag.NewFlagSet("mock-server", flag.ExitOnError)
+	port := fs.Int("port", 8090, "Port number for the mock tile server")
+	latency := fs.Duration("latency", 0, "Delay before every response, e.g. 200ms")
+	errorRate := fs.Float64("error-rate", 0, "Fraction of requests answered with 500 Internal Server Error (0-1)")
+	throttleRate := fs.Float64("429-rate", 0, "Fraction of requests answered with 429 Too Many Requests (0-1)")
+	retryAfter := fs.Int("retry-after", 1, "Retry-After header of 429 responses in seconds")
+	maxZoom := fs.Int("max-zoom", 22, "Highest zoom level with tiles, higher zoom levels are answered with 404 Not Found")
+	tileSize := fs.Int("tile-size", 256, "Width and height of the tiles in pixels (256 or 512)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s mock-server [options]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *errorRate < 0 || *throttleRate < 0 || *errorRate+*throttleRate > 1 {
+		log.Print("error-rate and 429-rate must be between 0 and 1 and together at most 1")
+		return 2
+	}
+	if *tileSize != 256 && *tileSize != 512 {
+		log.Printf("tile-size must be 256 or 512 (got %d)", *tileSize)
+		return 2
+	}
+	if *retryAfter < 0 || *maxZoom < 0 || *maxZoom > maxSourceZoom {
+		log.Printf("retry-after must not be negative and max-zoom must be 0-%d", maxSourceZoom)
+		return 2
+	}
+
+	m := &mockServer{
+		latency:      *latency,
+		errorRate:    *errorRate,
+		throttleRate: *throttleRate,
+		retryAfter:   *retryAfter,
+		maxZoom:      *maxZoom,
+		tileSize:     *tileSize,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{z}/{x}/{y}", m.serveTile)
+
+	addr := fmt.Sprintf(":%d", *port)
+	log.Printf("Serving mock tiles on http://localhost%s/{z}/{x}/{y}.png (or .jpg)", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Printf("Error starting mock server: %v", err)
+		return 1
+	}
+	return 0
+}
+
+// serveTile answers a tile request with a synthetic tile, or with an error at the configured rates.
+func (m *mockServer) serveTile(w http.ResponseWriter, r *http.Request) {
+	if m.latency > 0 {
+		select {
+		case <-time.After(m.latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	name, format, _ := strings.Cut(r.PathValue("y"), ".")
+	z, zErr := strconv.Atoi(r.PathValue("z"))
+	x, xErr := strconv.Atoi(r.PathValue("x"))
+	y, yErr := strconv.Atoi(name)
+	if zErr != nil || xErr != nil || yErr != nil || z < 0 || z > maxSourceZoom || x < 0 || y < 0 || x >= 1<<z || y >= 1<<z ||
+		(format != "png" && format != "jpg") {
+		http.NotFound(w, r)
+		return
+	}
+	if z > m.maxZoom {
+		http.Error(w, "No tiles at this zoom level", http.StatusNotFound)
+		return
+	}
+
+	switch p := rand.Float64(); {
+	case p < m.throttleRate:
+		w.Header().Set("Retry-After", strconv.Itoa(m.retryAfter))
+		http.Error(w, "Too many requests", http.StatusTooManyRequests)
+		return
+	case p < m.throttleRate+m.errorRate:
+		http.Error(w, "Random error of the mock server", http.StatusInternalServerError)
+		return
+	}
+
+	// The tiles never change, so they can be revalidated.
+	etag := fmt.Sprintf(`"%d-%d-%d-%d"`, z, x, y, m.tileSize)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "max-age=86400")
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	img := mockTileImage(Tile{X: uint32(x), Y: uint32(y), Z: uint32(z)}, m.tileSize)
+	var buf bytes.Buffer
+	var err error
+	if format == "jpg" {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90})
+	} else {
+		err = png.Encode(&buf, img)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", tileFormatContentType(format))
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		log.Printf("Could not write response: %v", err)
+	}
+}
+
+// mockFont is a 3×5 pixel font for the digits and the slash of tile coordinates.
+var mockFont = map[rune][5]string{
+	'0': {"###", "#.#", "#.#", "#.#", "###"},
+	'1': {".#.", "##.", ".#.", ".#.", "###"},
+	'2': {"###", "..#", "###", "#..", "###"},
+	'3': {"###", "..#", "###", "..#", "###"},
+	'4': {"#.#", "#.#", "###", "..#", "..#"},
+	'5': {"###", "#..", "###", "..#", "###"},
+	'6': {"###", "#..", "###", "#.#", "###"},
+	'7': {"###", "..#", "..#", "..#", "..#"},
+	'8': {"###", "#.#", "###", "#.#", "###"},
+	'9': {"###", "#.#", "###", "..#", "###"},
+	'/': {"..#", "..#", ".#.", "#..", "#.."},
+}
+
+// mockTileImage draws a tile with a background color derived from its coordinates, a border and "z/x/y" in the middle.
+// The same tile always gets the same image.
+func mockTileImage(tile Tile, size int) *image.RGBA {
+	hash := fnv.New32a()
+	fmt.Fprintf(hash, "%d/%d/%d", tile.Z, tile.X, tile.Y)
+	sum := hash.Sum32()
+	// Light colors keep the dark text readable.
+	background := color.RGBA{R: 160 + uint8(sum%96), G: 160 + uint8(sum>>8%96), B: 160 + uint8(sum>>16%96), A: 255}
+	border := color.RGBA{R: 64, G: 64, B: 64, A: 255}
+	text := color.RGBA{A: 255}
+
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	for py := 0; py < size; py++ {
+		for px := 0; px < size; px++ {
+			if px == 0 || py == 0 || px == size-1 || py == size-1 {
+				img.SetRGBA(px, py, border)
+			} else {
+				img.SetRGBA(px, py, background)
+			}
+		}
+	}
+
+	label := fmt.Sprintf("%d/%d/%d", tile.Z, tile.X, tile.Y)
+	width := len(label)*4 - 1 // Every glyph is 3 pixels wide with 1 pixel between glyphs.
+	scale := max(1, min(size*7/8/width, size/10))
+	left := (size - width*scale) / 2
+	top := (size - 5*scale) / 2
+	for i, r := range label {
+		glyph := mockFont[r]
+		for row, line := range glyph {
+			for col, pixel := range line {
+				if pixel != '#' {
+					continue
+				}
+				x0 := left + (i*4+col)*scale
+				y0 := top + row*scale
+				for py := y0; py < y0+scale; py++ {
+					for px := x0; px < x0+scale; px++ {
+						img.SetRGBA(px, py, text)
+					}
+				}
+			}
+		}
+	}
+	return img
+}
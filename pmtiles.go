@@ -0,0 +1,717 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// PMTiles v3 constants, see https://github.com/protomaps/PMTiles/blob/main/spec/v3/spec.md
+const (
+	pmtilesHeaderLength   = 127                         // Length of the fixed size header.
+	pmtilesRootMaxLength  = 16384 - pmtilesHeaderLength // Maximum length of the root directory.
+	pmtilesCompressNone   = 1                           // No compression.
+	pmtilesCompressGzip   = 2                           // Gzip compression.
+	pmtilesTileTypeMVT    = 1                           // Mapbox Vector Tiles.
+	pmtilesTileTypePNG    = 2                           // PNG images.
+	pmtilesTileTypeJPEG   = 3                           // JPEG images.
+	pmtilesTileTypeWebP   = 4                           // WebP images.
+	pmtilesTileTypeAVIF   = 5                           // AVIF images.
+	pmtilesMaxLeafEntries = 4096                        // Initial number of entries per leaf directory.
+)
+
+// pmtilesHeader is the fixed size header at the start of a PMTiles archive.
+type pmtilesHeader struct {
+	RootOffset, RootLength         uint64
+	MetadataOffset, MetadataLength uint64
+	LeafOffset, LeafLength         uint64
+	TileDataOffset, TileDataLength uint64
+	AddressedTiles                 uint64
+	TileEntries                    uint64
+	TileContents                   uint64
+	Clustered                      bool
+	InternalCompression            uint8
+	TileCompression                uint8
+	TileType                       uint8
+	MinZoom, MaxZoom               uint8
+	MinLonE7, MinLatE7             int32
+	MaxLonE7, MaxLatE7             int32
+	CenterZoom                     uint8
+	CenterLonE7, CenterLatE7       int32
+}
+
+// pmtilesEntry is a directory entry pointing to tile data or to a leaf directory (RunLength 0).
+type pmtilesEntry struct {
+	TileID    uint64
+	Offset    uint64
+	Length    uint32
+	RunLength uint32
+}
+
+// pmtilesTileID returns the position of a tile on the Hilbert curve over all zoom levels.
+func pmtilesTileID(tile Tile) uint64 {
+	id := (uint64(1)<<(2*tile.Z) - 1) / 3
+	n := uint32(1) << tile.Z
+	x, y := tile.X, tile.Y
+	for s := n / 2; s > 0; s /= 2 {
+		var rx, ry uint32
+		if x&s != 0 {
+			rx = 1
+		}
+		if y&s != 0 {
+			ry = 1
+		}
+		id += uint64(s) * uint64(s) * uint64((3*rx)^ry)
+		x, y = hilbertRotate(n, x, y, rx, ry)
+	}
+	return id
+}
+
+// pmtilesTile returns the tile at a position on the Hilbert curve.
+func pmtilesTile(id uint64) Tile {
+	var z uint32
+	for ; z < 32; z++ {
+		tiles := uint64(1) << (2 * z)
+		if id < tiles {
+			break
+		}
+		id -= tiles
+	}
+	n := uint32(1) << z
+	var x, y uint32
+	for s := uint32(1); s < n; s *= 2 {
+		rx := uint32(1 & (id / 2))
+		ry := uint32(1 & (id ^ uint64(rx)))
+		x, y = hilbertRotate(s, x, y, rx, ry)
+		x += s * rx
+		y += s * ry
+		id /= 4
+	}
+	return Tile{X: x, Y: y, Z: z}
+}
+
+// hilbertRotate rotates and flips a quadrant of the Hilbert curve.
+func hilbertRotate(n, x, y, rx, ry uint32) (uint32, uint32) {
+	if ry == 0 {
+		if rx == 1 {
+			x = n - 1 - x
+			y = n - 1 - y
+		}
+		return y, x
+	}
+	return x, y
+}
+
+// e7 converts a coordinate to the fixed point format of the header.
+func e7(f float64) int32 {
+	return int32(math.Round(f * 1e7))
+}
+
+// pmtilesTileType returns the PMTiles tile type of an image format.
+func pmtilesTileType(format string) uint8 {
+	switch format {
+	case "png":
+		return pmtilesTileTypePNG
+	case "jpg":
+		return pmtilesTileTypeJPEG
+	case "webp":
+		return pmtilesTileTypeWebP
+	case "pbf":
+		return pmtilesTileTypeMVT
+	default:
+		return 0
+	}
+}
+
+// pmtilesTileFormat returns the image format of a PMTiles tile type.
+func pmtilesTileFormat(tileType uint8) string {
+	switch tileType {
+	case pmtilesTileTypeJPEG:
+		return "jpg"
+	case pmtilesTileTypeWebP:
+		return "webp"
+	case pmtilesTileTypeMVT:
+		return "pbf"
+	default:
+		return "png"
+	}
+}
+
+// serialize encodes the header in its binary form.
+func (h pmtilesHeader) serialize() []byte {
+	b := make([]byte, pmtilesHeaderLength)
+	copy(b[0:7], "PMTiles")
+	b[7] = 3
+	binary.LittleEndian.PutUint64(b[8:], h.RootOffset)
+	binary.LittleEndian.PutUint64(b[16:], h.RootLength)
+	binary.LittleEndian.PutUint64(b[24:], h.MetadataOffset)
+	binary.LittleEndian.PutUint64(b[32:], h.MetadataLength)
+	binary.LittleEndian.PutUint64(b[40:], h.LeafOffset)
+	binary.LittleEndian.PutUint64(b[48:], h.LeafLength)
+	binary.LittleEndian.PutUint64(b[56:], h.TileDataOffset)
+	binary.LittleEndian.PutUint64(b[64:], h.TileDataLength)
+	binary.LittleEndian.PutUint64(b[72:], h.AddressedTiles)
+	binary.LittleEndian.PutUint64(b[80:], h.TileEntries)
+	binary.LittleEndian.PutUint64(b[88:], h.TileContents)
+	if h.Clustered {
+		b[96] = 1
+	}
+	b[97] = h.InternalCompression
+	b[98] = h.TileCompression
+	b[99] = h.TileType
+	b[100] = h.MinZoom
+	b[101] = h.MaxZoom
+	binary.LittleEndian.PutUint32(b[102:], uint32(h.MinLonE7))
+	binary.LittleEndian.PutUint32(b[106:], uint32(h.MinLatE7))
+	binary.LittleEndian.PutUint32(b[110:], uint32(h.MaxLonE7))
+	binary.LittleEndian.PutUint32(b[114:], uint32(h.MaxLatE7))
+	b[118] = h.CenterZoom
+	binary.LittleEndian.PutUint32(b[119:], uint32(h.CenterLonE7))
+	binary.LittleEndian.PutUint32(b[123:], uint32(h.CenterLatE7))
+	return b
+}
+
+// parsePMTilesHeader decodes the binary header of a PMTiles archive.
+func parsePMTilesHeader(b []byte) (pmtilesHeader, error) {
+	var h pmtilesHeader
+	if len(b) < pmtilesHeaderLength || string(b[0:7]) != "PMTiles" {
+		return h, errors.New("not a PMTiles archive")
+	}
+	if b[7] != 3 {
+		return h, fmt.Errorf("unsupported PMTiles version %d", b[7])
+	}
+	h.RootOffset = binary.LittleEndian.Uint64(b[8:])
+	h.RootLength = binary.LittleEndian.Uint64(b[16:])
+	h.MetadataOffset = binary.LittleEndian.Uint64(b[24:])
+	h.MetadataLength = binary.LittleEndian.Uint64(b[32:])
+	h.LeafOffset = binary.LittleEndian.Uint64(b[40:])
+	h.LeafLength = binary.LittleEndian.Uint64(b[48:])
+	h.TileDataOffset = binary.LittleEndian.Uint64(b[56:])
+	h.TileDataLength = binary.LittleEndian.Uint64(b[64:])
+	h.AddressedTiles = binary.LittleEndian.Uint64(b[72:])
+	h.TileEntries = binary.LittleEndian.Uint64(b[80:])
+	h.TileContents = binary.LittleEndian.Uint64(b[88:])
+	h.Clustered = b[96] == 1
+	h.InternalCompression = b[97]
+	h.TileCompression = b[98]
+	h.TileType = b[99]
+	h.MinZoom = b[100]
+	h.MaxZoom = b[101]
+	h.MinLonE7 = int32(binary.LittleEndian.Uint32(b[102:]))
+	h.MinLatE7 = int32(binary.LittleEndian.Uint32(b[106:]))
+	h.MaxLonE7 = int32(binary.LittleEndian.Uint32(b[110:]))
+	h.MaxLatE7 = int32(binary.LittleEndian.Uint32(b[114:]))
+	h.CenterZoom = b[118]
+	h.CenterLonE7 = int32(binary.LittleEndian.Uint32(b[119:]))
+	h.CenterLatE7 = int32(binary.LittleEndian.Uint32(b[123:]))
+	return h, nil
+}
+
+// serializePMTilesDirectory encodes and gzip compresses directory entries.
+func serializePMTilesDirectory(entries []pmtilesEntry) []byte {
+	var raw []byte
+	raw = binary.AppendUvarint(raw, uint64(len(entries)))
+	var lastID uint64
+	for _, e := range entries {
+		raw = binary.AppendUvarint(raw, e.TileID-lastID)
+		lastID = e.TileID
+	}
+	for _, e := range entries {
+		raw = binary.AppendUvarint(raw, uint64(e.RunLength))
+	}
+	for _, e := range entries {
+		raw = binary.AppendUvarint(raw, uint64(e.Length))
+	}
+	for i, e := range entries {
+		// An offset of 0 means the entry directly follows the previous one.
+		if i > 0 && e.Offset == entries[i-1].Offset+uint64(entries[i-1].Length) {
+			raw = binary.AppendUvarint(raw, 0)
+		} else {
+			raw = binary.AppendUvarint(raw, e.Offset+1)
+		}
+	}
+	return gzipBytes(raw)
+}
+
+// parsePMTilesDirectory decodes directory entries.
+func parsePMTilesDirectory(b []byte, compression uint8) ([]pmtilesEntry, error) {
+	b, err := decompressPMTiles(b, compression)
+	if err != nil {
+		return nil, err
+	}
+	r := bytes.NewReader(b)
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(len(b)) {
+		return nil, errors.New("invalid PMTiles directory")
+	}
+	entries := make([]pmtilesEntry, n)
+	var lastID uint64
+	for i := range entries {
+		v, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		lastID += v
+		entries[i].TileID = lastID
+	}
+	for i := range entries {
+		v, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		entries[i].RunLength = uint32(v)
+	}
+	for i := range entries {
+		v, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		entries[i].Length = uint32(v)
+	}
+	for i := range entries {
+		v, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		if v == 0 && i > 0 {
+			entries[i].Offset = entries[i-1].Offset + uint64(entries[i-1].Length)
+		} else {
+			entries[i].Offset = v - 1
+		}
+	}
+	return entries, nil
+}
+
+// gzipBytes compresses data with gzip.
+func gzipBytes(data []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	// Writing to a bytes.Buffer cannot fail.
+	_, _ = w.Write(data)
+	_ = w.Close()
+	return buf.Bytes()
+}
+
+// decompressPMTiles decompresses directories or metadata of a PMTiles archive.
+func decompressPMTiles(b []byte, compression uint8) ([]byte, error) {
+	switch compression {
+	case pmtilesCompressNone:
+		return b, nil
+	case pmtilesCompressGzip:
+		r, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		return io.ReadAll(r)
+	default:
+		return nil, fmt.Errorf("unsupported PMTiles compression %d", compression)
+	}
+}
+
+// buildPMTilesDirectories returns the root directory and leaf directories for the entries.
+// Leaf directories are only used if the root directory would not fit into the first 16 KiB.
+func buildPMTilesDirectories(entries []pmtilesEntry) (root, leaves []byte) {
+	root = serializePMTilesDirectory(entries)
+	if len(root) <= pmtilesRootMaxLength {
+		return root, nil
+	}
+	leafSize := pmtilesMaxLeafEntries
+	for {
+		var rootEntries []pmtilesEntry
+		var leafData []byte
+		for i := 0; i < len(entries); i += leafSize {
+			end := min(i+leafSize, len(entries))
+			leaf := serializePMTilesDirectory(entries[i:end])
+			rootEntries = append(rootEntries, pmtilesEntry{
+				TileID: entries[i].TileID,
+				Offset: uint64(len(leafData)),
+				Length: uint32(len(leaf)),
+			})
+			leafData = append(leafData, leaf...)
+		}
+		root = serializePMTilesDirectory(rootEntries)
+		if len(root) <= pmtilesRootMaxLength {
+			return root, leafData
+		}
+		leafSize += leafSize / 5
+	}
+}
+
+// exportPMTiles writes the tiles of a tile store into a clustered PMTiles archive and returns the number of tiles.
+func exportPMTiles(src tileStore, output string, opts exportOptions) (int, error) {
+	// Tiles are written in the order of their tile IDs, which makes the archive clustered.
+	var ids []uint64
+	err := src.Walk(func(tile Tile) error {
+		if opts.includes(tile) {
+			ids = append(ids, pmtilesTileID(tile))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, fmt.Errorf("no cached tiles found for the selected area and zoom levels")
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	// Write the tile data to a temporary file first, as the directories are stored before it.
+	tileData, err := os.CreateTemp(filepath.Dir(output), ".pmtiles-*")
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := tileData.Close(); err != nil {
+			log.Printf("Could not close temporary file: %v", err)
+		}
+		if err := os.Remove(tileData.Name()); err != nil {
+			log.Printf("Could not remove temporary file: %v", err)
+		}
+	}()
+	tileWriter := bufio.NewWriter(tileData)
+
+	summary := newExportSummary()
+	var entries []pmtilesEntry
+	contents := map[[sha256.Size]byte]uint64{} // Offsets of identical tiles, e.g. empty sea tiles.
+	var offset uint64
+	for _, id := range ids {
+		tile := pmtilesTile(id)
+		data, format, err := src.Get(tile)
+		if err != nil {
+			return 0, err
+		}
+		summary.add(tile, data, format)
+
+		hash := sha256.Sum256(data)
+		if contentOffset, ok := contents[hash]; ok {
+			last := &entries[len(entries)-1]
+			if last.Offset == contentOffset && last.TileID+uint64(last.RunLength) == id {
+				last.RunLength++
+			} else {
+				entries = append(entries, pmtilesEntry{TileID: id, Offset: contentOffset, Length: uint32(len(data)), RunLength: 1})
+			}
+			continue
+		}
+		if _, err := tileWriter.Write(data); err != nil {
+			return 0, err
+		}
+		contents[hash] = offset
+		entries = append(entries, pmtilesEntry{TileID: id, Offset: offset, Length: uint32(len(data)), RunLength: 1})
+		offset += uint64(len(data))
+	}
+	if err := tileWriter.Flush(); err != nil {
+		return 0, err
+	}
+
+	metadata := map[string]string{
+		"name":    opts.Name,
+		"type":    "baselayer",
+		"version": "1.1",
+		"format":  summary.format,
+		"bounds": fmt.Sprintf("%s,%s,%s,%s",
+			formatCoordinate(summary.bounds.West), formatCoordinate(summary.bounds.South),
+			formatCoordinate(summary.bounds.East), formatCoordinate(summary.bounds.North)),
+		"minzoom": fmt.Sprintf("%d", summary.minZoom),
+		"maxzoom": fmt.Sprintf("%d", summary.maxZoom),
+	}
+	if opts.Attribution != "" {
+		metadata["attribution"] = opts.Attribution
+	}
+	metadataJSON, err := json.Marshal(metadata)
+	if err != nil {
+		return 0, err
+	}
+	metadataData := gzipBytes(metadataJSON)
+
+	root, leaves := buildPMTilesDirectories(entries)
+	header := pmtilesHeader{
+		RootOffset:          pmtilesHeaderLength,
+		RootLength:          uint64(len(root)),
+		MetadataOffset:      pmtilesHeaderLength + uint64(len(root)),
+		MetadataLength:      uint64(len(metadataData)),
+		AddressedTiles:      uint64(len(ids)),
+		TileEntries:         uint64(len(entries)),
+		TileContents:        uint64(len(contents)),
+		Clustered:           true,
+		InternalCompression: pmtilesCompressGzip,
+		TileCompression:     summary.compression(),
+		TileType:            pmtilesTileType(summary.format),
+		MinZoom:             uint8(summary.minZoom),
+		MaxZoom:             uint8(summary.maxZoom),
+		MinLonE7:            e7(summary.bounds.West),
+		MinLatE7:            e7(summary.bounds.South),
+		MaxLonE7:            e7(summary.bounds.East),
+		MaxLatE7:            e7(summary.bounds.North),
+		CenterZoom:          uint8(summary.minZoom),
+		CenterLonE7:         e7((summary.bounds.West + summary.bounds.East) / 2),
+		CenterLatE7:         e7((summary.bounds.South + summary.bounds.North) / 2),
+	}
+	header.LeafOffset = header.MetadataOffset + header.MetadataLength
+	header.LeafLength = uint64(len(leaves))
+	header.TileDataOffset = header.LeafOffset + header.LeafLength
+	header.TileDataLength = offset
+
+	// The archive is written to a temporary file and renamed, so a failed export leaves an existing archive untouched
+	// and a server that has the old archive open keeps reading consistent data until it reopens it.
+	out, err := os.CreateTemp(filepath.Dir(output), filepath.Base(output)+".*"+tempFileSuffix)
+	if err != nil {
+		return 0, err
+	}
+	err = writePMTiles(out, tileData, header.serialize(), root, metadataData, leaves)
+	if err == nil {
+		// CreateTemp creates the file only readable by the owner.
+		err = os.Chmod(out.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(out.Name(), output)
+	}
+	if err != nil {
+		if removeErr := os.Remove(out.Name()); removeErr != nil && !errors.Is(removeErr, fs.ErrNotExist) {
+			log.Printf("Could not remove temporary file: %v", removeErr)
+		}
+		return 0, err
+	}
+	return len(ids), nil
+}
+
+// writePMTiles writes the sections of an archive followed by the tile data to a file, syncs and closes it.
+func writePMTiles(out *os.File, tileData io.ReadSeeker, sections ...[]byte) error {
+	w := bufio.NewWriter(out)
+	for _, section := range sections {
+		if _, err := w.Write(section); err != nil {
+			_ = out.Close()
+			return err
+		}
+	}
+	if _, err := tileData.Seek(0, io.SeekStart); err != nil {
+		_ = out.Close()
+		return err
+	}
+	if _, err := io.Copy(w, tileData); err != nil {
+		_ = out.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		_ = out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// pmtilesStore reads the tiles of a map style from a PMTiles archive.
+type pmtilesStore struct {
+	file   *os.File
+	header pmtilesHeader
+	root   []pmtilesEntry
+
+	leavesMutex sync.Mutex                // Mutex to protect access to the leaves map.
+	leaves      map[uint64][]pmtilesEntry // Leaf directories by offset.
+}
+
+// openPMTilesStore opens a PMTiles archive and reads its root directory.
+func openPMTilesStore(path string) (*pmtilesStore, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &pmtilesStore{file: file, leaves: map[uint64][]pmtilesEntry{}}
+	if err := s.readRoot(); err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("could not read %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// readRoot reads the header and the root directory.
+func (s *pmtilesStore) readRoot() error {
+	b := make([]byte, pmtilesHeaderLength)
+	if _, err := s.file.ReadAt(b, 0); err != nil {
+		return err
+	}
+	header, err := parsePMTilesHeader(b)
+	if err != nil {
+		return err
+	}
+	if header.TileCompression != pmtilesCompressNone && (header.TileCompression != pmtilesCompressGzip || header.TileType != pmtilesTileTypeMVT) {
+		return fmt.Errorf("unsupported tile compression %d", header.TileCompression)
+	}
+	s.header = header
+	s.root, err = s.readDirectory(header.RootOffset, header.RootLength)
+	return err
+}
+
+// readDirectory reads and decodes a directory.
+func (s *pmtilesStore) readDirectory(offset, length uint64) ([]pmtilesEntry, error) {
+	b := make([]byte, length)
+	if _, err := s.file.ReadAt(b, int64(offset)); err != nil {
+		return nil, err
+	}
+	return parsePMTilesDirectory(b, s.header.InternalCompression)
+}
+
+// leaf returns a leaf directory, reading it on first use.
+func (s *pmtilesStore) leaf(entry pmtilesEntry) ([]pmtilesEntry, error) {
+	s.leavesMutex.Lock()
+	defer s.leavesMutex.Unlock()
+	if entries, ok := s.leaves[entry.Offset]; ok {
+		return entries, nil
+	}
+	entries, err := s.readDirectory(s.header.LeafOffset+entry.Offset, uint64(entry.Length))
+	if err != nil {
+		return nil, err
+	}
+	s.leaves[entry.Offset] = entries
+	return entries, nil
+}
+
+// find returns the entry of the tile data of a tile.
+func (s *pmtilesStore) find(tile Tile) (pmtilesEntry, bool, error) {
+	id := pmtilesTileID(tile)
+	entries := s.root
+	// Root and leaf directories are at most three levels deep.
+	for depth := 0; depth < 4; depth++ {
+		i := sort.Search(len(entries), func(i int) bool { return entries[i].TileID > id }) - 1
+		if i < 0 {
+			return pmtilesEntry{}, false, nil
+		}
+		entry := entries[i]
+		if entry.RunLength > 0 {
+			return entry, id < entry.TileID+uint64(entry.RunLength), nil
+		}
+		var err error
+		if entries, err = s.leaf(entry); err != nil {
+			return pmtilesEntry{}, false, err
+		}
+	}
+	return pmtilesEntry{}, false, errors.New("PMTiles directories are nested too deeply")
+}
+
+// Has checks if the archive contains a tile.
+func (s *pmtilesStore) Has(tile Tile) bool {
+	_, ok, err := s.find(tile)
+	return err == nil && ok
+}
+
+// Get reads the data of a tile. The format is the tile type of the header.
+func (s *pmtilesStore) Get(tile Tile) ([]byte, string, error) {
+	entry, ok, err := s.find(tile)
+	if err != nil {
+		return nil, "", err
+	}
+	if !ok {
+		return nil, "", fs.ErrNotExist
+	}
+	data := make([]byte, entry.Length)
+	if _, err := s.file.ReadAt(data, int64(s.header.TileDataOffset+entry.Offset)); err != nil {
+		return nil, "", err
+	}
+	return data, pmtilesTileFormat(s.header.TileType), nil
+}
+
+// Put fails as PMTiles archives cannot be modified.
+func (s *pmtilesStore) Put(tile Tile, data []byte, format string) error {
+	return errors.New("PMTiles archives are read-only")
+}
+
+// Info returns no cache information, as PMTiles archives have none.
+func (s *pmtilesStore) Info(tile Tile) (tileInfo, error) {
+	if !s.Has(tile) {
+		return tileInfo{}, fs.ErrNotExist
+	}
+	return tileInfo{}, nil
+}
+
+// SetInfo fails as PMTiles archives cannot be modified.
+func (s *pmtilesStore) SetInfo(tile Tile, info tileInfo) error {
+	return errors.New("PMTiles archives are read-only")
+}
+
+// Delete fails as PMTiles archives cannot be modified.
+func (s *pmtilesStore) Delete(tile Tile) error {
+	return errors.New("PMTiles archives are read-only")
+}
+
+// Missing returns false as PMTiles archives do not record missing tiles.
+func (s *pmtilesStore) Missing(tile Tile) bool {
+	return false
+}
+
+// SetMissing fails as PMTiles archives cannot be modified.
+func (s *pmtilesStore) SetMissing(tile Tile) error {
+	return errors.New("PMTiles archives are read-only")
+}
+
+// WalkMissing does nothing as PMTiles archives do not record missing tiles.
+func (s *pmtilesStore) WalkMissing(fn func(tile Tile) error) error {
+	return nil
+}
+
+// Walk calls fn for every tile in the archive.
+func (s *pmtilesStore) Walk(fn func(tile Tile) error) error {
+	return s.walkEntries(s.root, 0, fn)
+}
+
+// walkEntries calls fn for every tile of the entries of a directory.
+func (s *pmtilesStore) walkEntries(entries []pmtilesEntry, depth int, fn func(tile Tile) error) error {
+	if depth > 3 {
+		return errors.New("PMTiles directories are nested too deeply")
+	}
+	for _, entry := range entries {
+		if entry.RunLength == 0 {
+			leaf, err := s.leaf(entry)
+			if err != nil {
+				return err
+			}
+			if err := s.walkEntries(leaf, depth+1, fn); err != nil {
+				return err
+			}
+			continue
+		}
+		for i := uint64(0); i < uint64(entry.RunLength); i++ {
+			if err := fn(pmtilesTile(entry.TileID + i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Sync does nothing as PMTiles archives cannot be modified.
+func (s *pmtilesStore) Sync() error {
+	return nil
+}
+
+// replaced reports whether the archive at path is no longer the opened file, e.g. after a new export.
+func (s *pmtilesStore) replaced(path string) bool {
+	opened, err := s.file.Stat()
+	if err != nil {
+		return true
+	}
+	current, err := os.Stat(path)
+	return err != nil || !os.SameFile(opened, current)
+}
+
+// Close closes the archive.
+func (s *pmtilesStore) Close() error {
+	return s.file.Close()
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/fs"
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPMTilesTileID(t *testing.T) {
+	// The tile IDs of the reference implementation.
+	tests := []struct {
+		tile Tile
+		id   uint64
+	}{
+		{Tile{Z: 0, X: 0, Y: 0}, 0},
+		{Tile{Z: 1, X: 0, Y: 0}, 1},
+		{Tile{Z: 1, X: 0, Y: 1}, 2},
+		{Tile{Z: 1, X: 1, Y: 1}, 3},
+		{Tile{Z: 1, X: 1, Y: 0}, 4},
+		{Tile{Z: 2, X: 0, Y: 0}, 5},
+		{Tile{Z: 3, X: 0, Y: 0}, 21},
+		{Tile{Z: 3, X: 7, Y: 0}, 84},
+		{Tile{Z: 12, X: 3423, Y: 1763}, 19078479},
+	}
+	for _, tt := range tests {
+		if got := pmtilesTileID(tt.tile); got != tt.id {
+			t.Errorf("pmtilesTileID(%s) = %d, want %d", tileKey(tt.tile), got, tt.id)
+		}
+		if got := pmtilesTile(tt.id); got != tt.tile {
+			t.Errorf("pmtilesTile(%d) = %s, want %s", tt.id, tileKey(got), tileKey(tt.tile))
+		}
+	}
+}
+
+func TestPMTilesTileIDRoundTrip(t *testing.T) {
+	// Every tile of a zoom level has its own ID within the range of the zoom level.
+	for z := uint32(0); z <= 8; z++ {
+		first := (uint64(1)<<(2*z) - 1) / 3
+		seen := make(map[uint64]bool)
+		for x := uint32(0); x < 1<<z; x++ {
+			for y := uint32(0); y < 1<<z; y++ {
+				tile := Tile{X: x, Y: y, Z: z}
+				id := pmtilesTileID(tile)
+				if id < first || id >= first+uint64(1)<<(2*z) || seen[id] {
+					t.Fatalf("tile %s has ID %d outside zoom level %d or used twice", tileKey(tile), id, z)
+				}
+				seen[id] = true
+				if got := pmtilesTile(id); got != tile {
+					t.Fatalf("pmtilesTile(pmtilesTileID(%s)) = %s", tileKey(tile), tileKey(got))
+				}
+			}
+		}
+	}
+
+	// The corners of the highest zoom levels.
+	for _, z := range []uint32{16, 24, 31} {
+		last := uint32(1)<<z - 1
+		for _, tile := range []Tile{{X: 0, Y: 0, Z: z}, {X: last, Y: 0, Z: z}, {X: 0, Y: last, Z: z}, {X: last, Y: last, Z: z}} {
+			if got := pmtilesTile(pmtilesTileID(tile)); got != tile {
+				t.Errorf("pmtilesTile(pmtilesTileID(%s)) = %s", tileKey(tile), tileKey(got))
+			}
+		}
+	}
+}
+
+func TestPMTilesDirectoryRoundTrip(t *testing.T) {
+	entries := []pmtilesEntry{
+		{TileID: 0, Offset: 0, Length: 100, RunLength: 1},
+		{TileID: 1, Offset: 100, Length: 50, RunLength: 3}, // Follows the previous entry.
+		{TileID: 5, Offset: 0, Length: 100, RunLength: 1},  // Points back to identical data.
+		{TileID: 1000, Offset: 150, Length: 7, RunLength: 1},
+		{TileID: 1001, Offset: 4096, Length: 1, RunLength: 0}, // A leaf directory.
+	}
+	got, err := parsePMTilesDirectory(serializePMTilesDirectory(entries), pmtilesCompressGzip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, entries) {
+		t.Errorf("got entries %+v, want %+v", got, entries)
+	}
+}
+
+func TestBuildPMTilesDirectories(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries int
+		leaves  bool
+	}{
+		{"root only", 100, false},
+		{"leaf directories", 100000, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Lengths that vary like real tiles keep the directories from compressing too well.
+			random := rand.New(rand.NewSource(1))
+			entries := make([]pmtilesEntry, tt.entries)
+			var offset uint64
+			for i := range entries {
+				length := uint32(100 + random.Intn(50000))
+				entries[i] = pmtilesEntry{TileID: uint64(i * 2), Offset: offset, Length: length, RunLength: 1}
+				offset += uint64(length)
+			}
+
+			root, leaves := buildPMTilesDirectories(entries)
+			if len(root) > pmtilesRootMaxLength {
+				t.Fatalf("root directory has %d bytes, more than %d", len(root), pmtilesRootMaxLength)
+			}
+			if (len(leaves) > 0) != tt.leaves {
+				t.Fatalf("got %d bytes of leaf directories, want leaves: %v", len(leaves), tt.leaves)
+			}
+
+			rootEntries, err := parsePMTilesDirectory(root, pmtilesCompressGzip)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []pmtilesEntry
+			for _, entry := range rootEntries {
+				if entry.RunLength > 0 {
+					got = append(got, entry)
+					continue
+				}
+				leaf, err := parsePMTilesDirectory(leaves[entry.Offset:entry.Offset+uint64(entry.Length)], pmtilesCompressGzip)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(leaf) == 0 || leaf[0].TileID != entry.TileID {
+					t.Fatalf("leaf directory at %d does not start with tile ID %d", entry.Offset, entry.TileID)
+				}
+				got = append(got, leaf...)
+			}
+			if !reflect.DeepEqual(got, entries) {
+				t.Errorf("the directories do not contain the %d entries", len(entries))
+			}
+		})
+	}
+}
+
+// memStore is a tile store in memory for tests.
+type memStore struct {
+	tiles map[Tile][]byte
+}
+
+func (s *memStore) Has(tile Tile) bool { _, ok := s.tiles[tile]; return ok }
+func (s *memStore) Get(tile Tile) ([]byte, string, error) {
+	data, ok := s.tiles[tile]
+	if !ok {
+		return nil, "", fs.ErrNotExist
+	}
+	return data, "png", nil
+}
+func (s *memStore) Put(tile Tile, data []byte, format string) error { s.tiles[tile] = data; return nil }
+func (s *memStore) Info(tile Tile) (tileInfo, error)                { return tileInfo{}, nil }
+func (s *memStore) SetInfo(tile Tile, info tileInfo) error          { return nil }
+func (s *memStore) Delete(tile Tile) error                          { delete(s.tiles, tile); return nil }
+func (s *memStore) Missing(tile Tile) bool                          { return false }
+func (s *memStore) SetMissing(tile Tile) error                      { return nil }
+func (s *memStore) WalkMissing(fn func(tile Tile) error) error      { return nil }
+func (s *memStore) Sync() error                                     { return nil }
+func (s *memStore) Close() error                                    { return nil }
+func (s *memStore) Walk(fn func(tile Tile) error) error {
+	for tile := range s.tiles {
+		if err := fn(tile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestExportPMTiles(t *testing.T) {
+	// Every tile up to zoom level 8, with identical "sea" tiles in every third column.
+	src := &memStore{tiles: map[Tile][]byte{}}
+	sea := []byte("\x89PNG\r\n\x1a\nsea")
+	for z := uint32(0); z <= 8; z++ {
+		for x := uint32(0); x < 1<<z; x++ {
+			for y := uint32(0); y < 1<<z; y++ {
+				tile := Tile{X: x, Y: y, Z: z}
+				if x%3 == 0 {
+					src.tiles[tile] = sea
+					continue
+				}
+				// Varying lengths keep the directories from compressing too well, so leaf directories are needed.
+				data := []byte("\x89PNG\r\n\x1a\n" + tileKey(tile))
+				data = append(data, bytes.Repeat([]byte{0}, int(pmtilesTileID(tile)*7919%300))...)
+				src.tiles[tile] = binary.BigEndian.AppendUint32(data, x^y)
+			}
+		}
+	}
+
+	output := filepath.Join(t.TempDir(), "test.pmtiles")
+	count, err := exportPMTiles(src, output, exportOptions{MaxZoom: maxSourceZoom, Name: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != len(src.tiles) {
+		t.Errorf("exported %d tiles, want %d", count, len(src.tiles))
+	}
+
+	store, err := openPMTilesStore(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if store.header.LeafLength == 0 {
+		t.Error("the archive has no leaf directories")
+	}
+	if store.header.TileContents >= store.header.AddressedTiles {
+		t.Errorf("%d tile contents for %d tiles, identical tiles are not stored once", store.header.TileContents, store.header.AddressedTiles)
+	}
+
+	var walked int
+	err = store.Walk(func(tile Tile) error {
+		walked++
+		data, _, err := store.Get(tile)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(data, src.tiles[tile]) {
+			t.Errorf("tile %s has different data", tileKey(tile))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if walked != len(src.tiles) {
+		t.Errorf("walked %d tiles, want %d", walked, len(src.tiles))
+	}
+	if store.Has(Tile{X: 0, Y: 0, Z: 9}) {
+		t.Error("the archive has a tile that was not exported")
+	}
+}
+
+func TestGetTileStorePMTiles(t *testing.T) {
+	dir := t.TempDir()
+	oldCacheDir := cacheDir
+	cacheDir = &dir
+	defer func() {
+		closeTileStores()
+		cacheDir = oldCacheDir
+	}()
+
+	tile := Tile{X: 0, Y: 0, Z: 0}
+	export := func(data string) {
+		t.Helper()
+		src := &memStore{tiles: map[Tile][]byte{tile: []byte("\x89PNG\r\n\x1a\n" + data)}}
+		if _, err := exportPMTiles(src, filepath.Join(dir, "test.pmtiles"), exportOptions{MaxZoom: maxSourceZoom}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	get := func(create bool) (tileStore, string) {
+		t.Helper()
+		store, err := getTileStore("test", create)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _, err := store.Get(tile)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			t.Fatal(err)
+		}
+		return store, string(data)
+	}
+
+	export("old")
+	store, data := get(false)
+	if _, ok := store.(*pmtilesStore); !ok || !strings.HasSuffix(data, "old") {
+		t.Fatalf("got %T with tile %q, want the archive", store, data)
+	}
+
+	// A new export replaces the archive, so it is opened again.
+	export("new")
+	if _, data := get(false); !strings.HasSuffix(data, "new") {
+		t.Errorf("got tile %q after a new export, want the new archive", data)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dir, "*"+tempFileSuffix)); len(matches) > 0 {
+		t.Errorf("temporary files were left behind: %v", matches)
+	}
+
+	// Downloads use a tile directory, which then takes precedence over the archive.
+	store, _ = get(true)
+	if _, ok := store.(*dirStore); !ok {
+		t.Fatalf("got %T for a download, want a tile directory", store)
+	}
+	if err := store.Put(tile, []byte("\x89PNG\r\n\x1a\ndownloaded"), "png"); err != nil {
+		t.Fatal(err)
+	}
+	if store, data := get(false); !strings.HasSuffix(data, "downloaded") {
+		t.Errorf("got %T with tile %q after a download, want the tile directory", store, data)
+	}
+}
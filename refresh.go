@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Refresh modes for tiles that already exist.
+const (
+	refreshSkip      = "skip"      // Keep existing tiles (default).
+	refreshOverwrite = "overwrite" // Download all tiles again.
+	refreshOlder     = "older"     // Refresh tiles that were fetched more than refresh_days ago.
+	refreshExpired   = "expired"   // Refresh tiles that expired according to Cache-Control or Expires.
+)
+
+// tileInfo holds the cache information of a stored tile.
+type tileInfo struct {
+	Fetched      time.Time `json:"fetched"`                 // The time the tile was downloaded or revalidated.
+	Expires      time.Time `json:"expires,omitzero"`        // The time the tile expires according to the server.
+	ETag         string    `json:"etag,omitempty"`          // The ETag header of the tile.
+	LastModified string    `json:"last_modified,omitempty"` // The Last-Modified header of the tile.
+}
+
+// hasValidators checks if the tile can be revalidated with a conditional request.
+func (i tileInfo) hasValidators() bool {
+	return i.ETag != "" || i.LastModified != ""
+}
+
+// setConditionalHeaders makes a request conditional, so the server answers 304 if the tile is unchanged.
+func (i tileInfo) setConditionalHeaders(req *http.Request) {
+	if i.ETag != "" {
+		req.Header.Set("If-None-Match", i.ETag)
+	}
+	if i.LastModified != "" {
+		req.Header.Set("If-Modified-Since", i.LastModified)
+	}
+}
+
+// responseTileInfo returns the cache information of a tile response.
+// Cache-Control takes precedence over Expires. A tile that must not be cached expires immediately.
+func responseTileInfo(header http.Header, now time.Time) tileInfo {
+	info := tileInfo{
+		Fetched:      now,
+		ETag:         header.Get("ETag"),
+		LastModified: header.Get("Last-Modified"),
+	}
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch strings.ToLower(name) {
+		case "no-store", "no-cache":
+			info.Expires = now
+			return info
+		case "max-age":
+			seconds, err := strconv.Atoi(strings.Trim(value, `"`))
+			if err != nil {
+				continue
+			}
+			// The Age header tells how long a proxy has cached the response already.
+			age, _ := strconv.Atoi(header.Get("Age"))
+			info.Expires = now.Add(time.Duration(seconds-age) * time.Second)
+			return info
+		}
+	}
+	if expires := header.Get("Expires"); expires != "" {
+		// An invalid date means the response is already expired.
+		t, err := http.ParseTime(expires)
+		if err != nil {
+			t = now
+		}
+		info.Expires = t
+	}
+	return info
+}
+
+// revalidated returns the cache information of a tile after the server answered 304 Not Modified.
+// Validators missing from the response are kept from the stored tile.
+func (i tileInfo) revalidated(header http.Header, now time.Time) tileInfo {
+	info := responseTileInfo(header, now)
+	if info.ETag == "" {
+		info.ETag = i.ETag
+	}
+	if info.LastModified == "" {
+		info.LastModified = i.LastModified
+	}
+	return info
+}
+
+// refreshPolicy decides which existing tiles of a download job are downloaded again.
+type refreshPolicy struct {
+	mode   string        // The refresh mode.
+	maxAge time.Duration // The age after which tiles are refreshed in the "older" mode.
+}
+
+// newRefreshPolicy returns the refresh policy of a download request.
+func newRefreshPolicy(req DownloadRequest) refreshPolicy {
+	mode := req.Refresh
+	if mode == "" {
+		mode = refreshSkip
+	}
+	return refreshPolicy{mode: mode, maxAge: time.Duration(req.RefreshDays) * 24 * time.Hour}
+}
+
+// due checks if an existing tile must be downloaded again.
+// Tiles without a known download or expiry time are refreshed.
+func (p refreshPolicy) due(info tileInfo, now time.Time) bool {
+	switch p.mode {
+	case refreshOverwrite:
+		return true
+	case refreshOlder:
+		return info.Fetched.IsZero() || now.Sub(info.Fetched) >= p.maxAge
+	case refreshExpired:
+		return info.Expires.IsZero() || !now.Before(info.Expires)
+	default:
+		return false
+	}
+}
+
+// conditional checks if an existing tile is refreshed with a conditional request.
+// Overwriting always downloads the tile again.
+func (p refreshPolicy) conditional() bool {
+	return p.mode == refreshOlder || p.mode == refreshExpired
+}
+
+// validateRefresh checks the refresh mode and age of a download request.
+func validateRefresh(mode string, days int) error {
+	switch mode {
+	case "", refreshSkip, refreshOverwrite, refreshExpired:
+		return nil
+	case refreshOlder:
+		if days < 1 {
+			return fmt.Errorf("Invalid refresh age (must be at least 1 day)")
+		}
+		return nil
+	default:
+		return fmt.Errorf("Invalid refresh mode %q (must be skip, overwrite, older or expired)", mode)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"os"
+	"regexp"
+	"sync"
+)
+
+// envReference matches a ${NAME} reference to an environment variable in a header or cookie value.
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces the ${NAME} references in a value with the environment variables,
+// so API keys and session tokens do not have to be written into the sources file.
+func expandEnv(value string) (string, error) {
+	var err error
+	expanded := envReference.ReplaceAllStringFunc(value, func(ref string) string {
+		name := envReference.FindStringSubmatch(ref)[1]
+		env, ok := os.LookupEnv(name)
+		if !ok && err == nil {
+			err = fmt.Errorf("environment variable %s is not set", name)
+		}
+		return env
+	})
+	return expanded, err
+}
+
+// requestHeaders returns the headers and cookies of the source with the environment variables expanded.
+func (s MapSource) requestHeaders() (http.Header, []*http.Cookie, error) {
+	header := http.Header{}
+	for name, value := range s.Headers {
+		expanded, err := expandEnv(value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("header %s: %w", name, err)
+		}
+		header.Set(name, expanded)
+	}
+	var cookies []*http.Cookie
+	for name, value := range s.Cookies {
+		expanded, err := expandEnv(value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cookie %s: %w", name, err)
+		}
+		cookies = append(cookies, &http.Cookie{Name: name, Value: expanded})
+	}
+	return header, cookies, nil
+}
+
+// Cookie jars of the map sources that keep the cookies set by their servers, by URL template.
+var (
+	sourceCookieJars      = map[string]*cookiejar.Jar{}
+	sourceCookieJarsMutex sync.Mutex
+)
+
+// cookieJar returns the cookie jar of the source, or nil if the source does not keep cookies.
+// Every source has its own jar, so its cookies are never sent to other sources.
+func (s MapSource) cookieJar() *cookiejar.Jar {
+	if !s.CookieJar {
+		return nil
+	}
+	sourceCookieJarsMutex.Lock()
+	defer sourceCookieJarsMutex.Unlock()
+	jar, ok := sourceCookieJars[s.URL]
+	if !ok {
+		// New only fails for invalid options.
+		jar, _ = cookiejar.New(nil)
+		sourceCookieJars[s.URL] = jar
+	}
+	return jar
+}
+
+// setRequestHeaders adds the headers and cookies of the source to a tile request.
+// The headers replace the basic headers, and cookies set by the server replace the configured cookies of the same name.
+func (s MapSource) setRequestHeaders(req *http.Request) error {
+	header, cookies, err := s.requestHeaders()
+	if err != nil {
+		return err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	sent := map[string]bool{}
+	if jar := s.cookieJar(); jar != nil {
+		for _, cookie := range jar.Cookies(req.URL) {
+			req.AddCookie(cookie)
+			sent[cookie.Name] = true
+		}
+	}
+	for _, cookie := range cookies {
+		if !sent[cookie.Name] {
+			req.AddCookie(cookie)
+		}
+	}
+	return nil
+}
+
+// storeCookies keeps the cookies of a tile response in the cookie jar of the source.
+func (s MapSource) storeCookies(resp *http.Response) {
+	if jar := s.cookieJar(); jar != nil {
+		jar.SetCookies(resp.Request.URL, resp.Cookies())
+	}
+}
@@ -0,0 +1,533 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// mapSourcesFileName is the name of the user sources file that is looked up next to the binary and in the maps directory.
+const mapSourcesFileName = "map_sources.json"
+
+// mapSourcesWatchInterval is the time between two checks of the user sources files for changes.
+const mapSourcesWatchInterval = 5 * time.Second
+
+// Defaults for the optional fields of a map source.
+const (
+	defaultSourceMaxZoom = 19  // The maximum zoom level of a source that does not declare one.
+	maxSourceZoom        = 24  // The highest zoom level a source can declare.
+	defaultTileSize      = 256 // The tile size of a source that does not declare one.
+)
+
+// defaultSubdomains are the subdomains for {s} of a source that does not declare any.
+var defaultSubdomains = []string{"a", "b", "c"}
+
+// MapSource is the configuration of a map source.
+// In a map sources file a source is either a URL template string or an object with these fields.
+type MapSource struct {
+	Type         string            `json:"type,omitempty"`         // The type of the source, xyz or wms (default: xyz).
+	URL          string            `json:"url"`                    // The tile URL template, or the service URL of a WMS source.
+	MinZoom      int               `json:"min_zoom"`               // The minimum zoom level of the source.
+	MaxZoom      *int              `json:"max_zoom,omitempty"`     // The maximum zoom level of the source (default: 19), see maxZoom.
+	Bounds       []float64         `json:"bounds,omitempty"`       // The area the source provides as west, south, east, north (default: world).
+	Subdomains   []string          `json:"subdomains,omitempty"`   // The subdomains for {s} (default: a, b, c).
+	Attribution  string            `json:"attribution,omitempty"`  // The attribution shown on the map and stored in exports.
+	TileSize     int               `json:"tile_size,omitempty"`    // The width and height of the tiles in pixels (default: 256).
+	Format       string            `json:"format,omitempty"`       // The image format of the tiles (png, jpg, webp, gif or pbf).
+	Headers      map[string]string `json:"headers,omitempty"`      // Additional HTTP headers for tile requests. Values may contain ${ENV_VAR} references.
+	Cookies      map[string]string `json:"cookies,omitempty"`      // Cookies for tile requests. Values may contain ${ENV_VAR} references.
+	CookieJar    bool              `json:"cookie_jar,omitempty"`   // Keep the cookies set by the tile server, e.g. a session cookie, for later requests.
+	UsagePolicy  string            `json:"usage_policy,omitempty"` // The URL or text of the tile usage policy.
+	Variables    map[string]string `json:"variables,omitempty"`    // Values for custom placeholders in the URL template, e.g. {apikey}.
+	MinBytes     int               `json:"min_bytes,omitempty"`    // The minimum size of a tile in bytes. Smaller responses are rejected.
+	Placeholders []string          `json:"placeholders,omitempty"` // The SHA-256 hashes of placeholder tiles that are rejected, e.g. "no imagery" images.
+	WMS          *WMSOptions       `json:"wms,omitempty"`          // The GetMap parameters of a WMS source.
+}
+
+// withDefaults returns the source with the defaults filled in for fields that are not set.
+func (s MapSource) withDefaults() MapSource {
+	if s.MaxZoom == nil {
+		maxZoom := defaultSourceMaxZoom
+		s.MaxZoom = &maxZoom
+	}
+	if len(s.Subdomains) == 0 {
+		s.Subdomains = defaultSubdomains
+	}
+	if s.TileSize == 0 {
+		s.TileSize = defaultTileSize
+	}
+	// A WMS source gets the URL template of its GetMap requests.
+	if s.Type == sourceTypeWMS && s.WMS != nil {
+		wms := s.WMS.withDefaults()
+		s.WMS = &wms
+		if template, err := wmsTemplate(s.URL, wms, s.TileSize); err == nil {
+			s.URL = template
+		}
+	}
+	return s
+}
+
+// maxZoom returns the maximum zoom level of the source. A source that only has zoom level 0 sets it to 0.
+func (s MapSource) maxZoom() int {
+	if s.MaxZoom == nil {
+		return defaultSourceMaxZoom
+	}
+	return *s.MaxZoom
+}
+
+// covers checks if a tile is within the bounds of the source.
+func (s MapSource) covers(tile Tile) bool {
+	if len(s.Bounds) != 4 {
+		return true
+	}
+	bounds := tileBounds(tile)
+	return bounds.West < s.Bounds[2] && bounds.East > s.Bounds[0] && bounds.South < s.Bounds[3] && bounds.North > s.Bounds[1]
+}
+
+// accept returns the Accept header for tile requests of the source.
+func (s MapSource) accept() string {
+	if s.Type == sourceTypeWMS && s.WMS != nil {
+		return s.WMS.Format
+	}
+	return tileFormatAccept(s.Format)
+}
+
+// isPlain checks if the source only has a URL template and can be written in the short string form.
+func (s MapSource) isPlain() bool {
+	return reflect.DeepEqual(s, MapSource{URL: s.URL})
+}
+
+var (
+	sourcesFile     *string      // The user sources file given on the command line.
+	mapSourceNames  []string     // The names of the map sources in the order they were loaded.
+	mapSourcesMutex sync.RWMutex // Guards mapSources and mapSourceNames, which are replaced on reload.
+)
+
+// registerSourcesFlag registers the flag for the user sources file.
+func registerSourcesFlag(fs *flag.FlagSet) {
+	sourcesFile = fs.String("sources", "", "JSON file with additional map sources (name: URL template), merged with the built-in sources")
+}
+
+// mapSourcesFiles returns the user sources files in the order they are merged.
+// The file given with -sources is required; the default files are only used if they exist.
+func mapSourcesFiles() []string {
+	var files []string
+	if exe, err := os.Executable(); err == nil {
+		files = append(files, filepath.Join(filepath.Dir(exe), mapSourcesFileName))
+	}
+	files = append(files, filepath.Join(*cacheDir, mapSourcesFileName))
+	if *sourcesFile != "" {
+		files = append(files, *sourcesFile)
+	}
+	return files
+}
+
+// loadMapSources loads the embedded map sources and merges the user sources files into them.
+// Sources in a later file replace sources with the same name.
+func loadMapSources() error {
+	names, sources, err := parseMapSources(mapSourcesJSON)
+	if err != nil {
+		return fmt.Errorf("built-in map sources: %w", err)
+	}
+
+	for _, file := range mapSourcesFiles() {
+		data, err := os.ReadFile(file)
+		if errors.Is(err, os.ErrNotExist) && file != *sourcesFile {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		fileNames, fileSources, err := parseMapSources(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+		for _, name := range fileNames {
+			if _, ok := sources[name]; !ok {
+				names = append(names, name)
+			}
+			sources[name] = fileSources[name]
+		}
+		log.Printf("Loaded %d map sources from %s", len(fileNames), file)
+	}
+
+	mapSourcesMutex.Lock()
+	defer mapSourcesMutex.Unlock()
+	mapSourceNames = names
+	mapSources = sources
+	return nil
+}
+
+// parseMapSources parses a JSON object of map sources and returns the names in the order of the file.
+func parseMapSources(data []byte) ([]string, map[string]MapSource, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if token, err := dec.Token(); err != nil || token != json.Delim('{') {
+		return nil, nil, errors.New("map sources must be a JSON object")
+	}
+	var names []string
+	sources := make(map[string]MapSource)
+	for dec.More() {
+		token, err := dec.Token()
+		if err != nil {
+			return nil, nil, err
+		}
+		name := token.(string)
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return nil, nil, fmt.Errorf("map source %q: %w", name, err)
+		}
+		source, err := parseMapSource(raw)
+		if err != nil {
+			return nil, nil, fmt.Errorf("map source %q: %w", name, err)
+		}
+		if err := validateMapSource(source); err != nil {
+			return nil, nil, fmt.Errorf("map source %q: %w", name, err)
+		}
+		if _, ok := sources[name]; !ok {
+			names = append(names, name)
+		}
+		sources[name] = source
+	}
+	return names, sources, nil
+}
+
+// parseMapSource parses a map source in the string or object form.
+func parseMapSource(raw json.RawMessage) (MapSource, error) {
+	var source MapSource
+	if err := json.Unmarshal(raw, &source.URL); err == nil {
+		return source, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields() // Report typos in field names instead of ignoring them.
+	if err := dec.Decode(&source); err != nil {
+		return source, err
+	}
+	return source, nil
+}
+
+// lookupMapSource returns a map source by name with the defaults filled in.
+func lookupMapSource(name string) (MapSource, bool) {
+	mapSourcesMutex.RLock()
+	defer mapSourcesMutex.RUnlock()
+	source, ok := mapSources[name]
+	return source.withDefaults(), ok
+}
+
+// findMapSource returns the map source with a URL template with the defaults filled in.
+// URL templates that are not configured as map source get the default configuration.
+func findMapSource(urlTemplate string) MapSource {
+	names, sources := listMapSources()
+	for _, name := range names {
+		if source := sources[name].withDefaults(); source.URL == urlTemplate {
+			return source
+		}
+	}
+	return MapSource{URL: urlTemplate}.withDefaults()
+}
+
+// listMapSources returns the names of the map sources in order and a copy of the sources.
+func listMapSources() ([]string, map[string]MapSource) {
+	mapSourcesMutex.RLock()
+	defer mapSourcesMutex.RUnlock()
+	sources := make(map[string]MapSource, len(mapSources))
+	for name, source := range mapSources {
+		sources[name] = source
+	}
+	return append([]string(nil), mapSourceNames...), sources
+}
+
+// encodeMapSources encodes the map sources with the defaults filled in as JSON object in the order they were loaded.
+func encodeMapSources() ([]byte, error) {
+	names, sources := listMapSources()
+	return marshalMapSources(names, func(name string) interface{} {
+		return sources[name].withDefaults()
+	})
+}
+
+// marshalMapSources encodes map sources as JSON object in the order of the names.
+func marshalMapSources(names []string, value func(name string) interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false) // Keep the & in URL templates readable.
+	buf.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		if err := enc.Encode(name); err != nil {
+			return nil, err
+		}
+		buf.WriteByte(':')
+		if err := enc.Encode(value(name)); err != nil {
+			return nil, err
+		}
+	}
+	buf.WriteByte('}')
+	// Remove the newlines the encoder adds after each value.
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, buf.Bytes()); err != nil {
+		return nil, err
+	}
+	return compact.Bytes(), nil
+}
+
+// errSourceExists is returned when a map source that already exists is added.
+var errSourceExists = errors.New("map source already exists")
+
+// errInvalidSource is returned when a map source has an invalid name or configuration.
+var errInvalidSource = errors.New("invalid map source")
+
+// errSourceNotFound is returned when a map source that is not in the user sources file of the maps directory is deleted.
+var errSourceNotFound = errors.New("map source not found in the user sources of the maps directory")
+
+// userSourcesMutex serializes changes to the user sources file of the maps directory.
+var userSourcesMutex sync.Mutex
+
+// userSourcesPath returns the path of the user sources file in the maps directory, which is managed by the HTTP API.
+func userSourcesPath() string {
+	return filepath.Join(*cacheDir, mapSourcesFileName)
+}
+
+// putUserSource adds or replaces a map source in the user sources file of the maps directory.
+// If replace is false, an existing source with the same name is an error.
+func putUserSource(name string, source MapSource, replace bool) error {
+	if err := validateSourceName(name); err != nil {
+		return fmt.Errorf("%w: %v", errInvalidSource, err)
+	}
+	if err := validateMapSource(source); err != nil {
+		return fmt.Errorf("%w: %v", errInvalidSource, err)
+	}
+	if _, ok := lookupMapSource(name); ok && !replace {
+		return fmt.Errorf("%w: %s", errSourceExists, name)
+	}
+	return updateUserSources(func(names []string, sources map[string]MapSource) ([]string, error) {
+		if _, ok := sources[name]; !ok {
+			names = append(names, name)
+		}
+		sources[name] = source
+		return names, nil
+	})
+}
+
+// deleteUserSource removes a map source from the user sources file of the maps directory.
+// Built-in sources and sources of other files cannot be deleted.
+func deleteUserSource(name string) error {
+	return updateUserSources(func(names []string, sources map[string]MapSource) ([]string, error) {
+		if _, ok := sources[name]; !ok {
+			return nil, fmt.Errorf("%w: %s", errSourceNotFound, name)
+		}
+		delete(sources, name)
+		kept := names[:0]
+		for _, n := range names {
+			if n != name {
+				kept = append(kept, n)
+			}
+		}
+		return kept, nil
+	})
+}
+
+// updateUserSources changes the user sources file of the maps directory and reloads the map sources.
+func updateUserSources(update func(names []string, sources map[string]MapSource) ([]string, error)) error {
+	userSourcesMutex.Lock()
+	defer userSourcesMutex.Unlock()
+
+	path := userSourcesPath()
+	var names []string
+	sources := make(map[string]MapSource)
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if names, sources, err = parseMapSources(data); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	if names, err = update(names, sources); err != nil {
+		return err
+	}
+
+	// Sources that only have a URL template are written in the short string form.
+	data, err = marshalMapSources(names, func(name string) interface{} {
+		if sources[name].isPlain() {
+			return sources[name].URL
+		}
+		return sources[name]
+	})
+	if err != nil {
+		return err
+	}
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, data, "", "  "); err != nil {
+		return err
+	}
+	indented.WriteByte('\n')
+	if err := writeFileAtomic(path, indented.Bytes()); err != nil {
+		return err
+	}
+	return loadMapSources()
+}
+
+// sourceFormats are the tile formats a map source can declare.
+var sourceFormats = map[string]bool{"png": true, "jpg": true, "webp": true, "gif": true, "pbf": true}
+
+// validateMapSource checks the URL template and the optional fields of a map source.
+func validateMapSource(source MapSource) error {
+	switch source.Type {
+	case "", sourceTypeXYZ:
+	case sourceTypeWMS:
+		if err := validateWMSOptions(source.WMS); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid type %q (must be xyz or wms)", source.Type)
+	}
+	s := source.withDefaults()
+	if err := validateURLTemplate(s.URL, s.Variables); err != nil {
+		return err
+	}
+	if s.MinZoom < 0 || s.maxZoom() > maxSourceZoom || s.MinZoom > s.maxZoom() {
+		return fmt.Errorf("invalid zoom range %d-%d (must be 0-%d, min <= max)", s.MinZoom, s.maxZoom(), maxSourceZoom)
+	}
+	if b := s.Bounds; b != nil && (len(b) != 4 || b[0] < -180 || b[2] > 180 || b[1] < -90 || b[3] > 90 || b[0] >= b[2] || b[1] >= b[3]) {
+		return fmt.Errorf("invalid bounds %v (must be west, south, east, north)", b)
+	}
+	if s.TileSize != 256 && s.TileSize != 512 {
+		return fmt.Errorf("invalid tile size %d (must be 256 or 512)", s.TileSize)
+	}
+	if s.Format != "" && !sourceFormats[s.Format] {
+		return fmt.Errorf("invalid format %q (must be png, jpg, webp, gif or pbf)", s.Format)
+	}
+	for _, subdomain := range s.Subdomains {
+		if subdomain == "" || strings.ContainsAny(subdomain, "/?#{}") {
+			return fmt.Errorf("invalid subdomain %q", subdomain)
+		}
+	}
+	for name := range s.Variables {
+		if name == "" || strings.ContainsAny(name, "{}") || urlPlaceholders["{"+name+"}"] || strings.HasPrefix("{"+name, switchPrefix) {
+			return fmt.Errorf("invalid variable name %q", name)
+		}
+	}
+	for header, value := range s.Headers {
+		if header == "" || strings.ContainsAny(header, " :\r\n") {
+			return fmt.Errorf("invalid header name %q", header)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("invalid value of header %s", header)
+		}
+	}
+	for cookie, value := range s.Cookies {
+		if cookie == "" || strings.ContainsAny(cookie, " =;,\t\r\n") {
+			return fmt.Errorf("invalid cookie name %q", cookie)
+		}
+		if strings.ContainsAny(value, ";\r\n") {
+			return fmt.Errorf("invalid value of cookie %s", cookie)
+		}
+	}
+	if s.MinBytes < 0 {
+		return fmt.Errorf("invalid min_bytes %d (must be >= 0)", s.MinBytes)
+	}
+	for _, hash := range s.Placeholders {
+		if b, err := hex.DecodeString(hash); err != nil || len(b) != sha256.Size {
+			return fmt.Errorf("invalid placeholder hash %q (must be a hex encoded SHA-256 hash)", hash)
+		}
+	}
+	return nil
+}
+
+// validateSourceName checks that a map source name can be used as name of a cache directory.
+func validateSourceName(name string) error {
+	if strings.TrimSpace(name) == "" || sanitizeStyleName(name) == "" {
+		return fmt.Errorf("name %q must contain letters or numbers", name)
+	}
+	if len(name) > 100 {
+		return errors.New("name is too long (max. 100 characters)")
+	}
+	return nil
+}
+
+// maxDocumentSize is the maximum size of a downloaded capabilities or TileJSON document.
+const maxDocumentSize = 10 << 20
+
+// fetchDocument reads a file or downloads an http or https URL, e.g. a capabilities document to import sources from.
+func fetchDocument(location string) ([]byte, error) {
+	if !strings.HasPrefix(location, "http://") && !strings.HasPrefix(location, "https://") {
+		return os.ReadFile(location)
+	}
+	req, err := http.NewRequest("GET", location, nil)
+	if err != nil {
+		return nil, err
+	}
+	if userAgent != nil {
+		req.Header.Set("User-Agent", *userAgent)
+	} else {
+		req.Header.Set("User-Agent", generateUserAgent())
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Printf("Could not close response body: %v", err)
+		}
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxDocumentSize))
+}
+
+// watchMapSources reloads the map sources on SIGHUP or when a user sources file changes.
+func watchMapSources() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(mapSourcesWatchInterval)
+	defer ticker.Stop()
+
+	modTimes := mapSourcesModTimes()
+	for {
+		select {
+		case <-hup:
+			log.Println("Received SIGHUP, reloading map sources")
+		case <-ticker.C:
+			current := mapSourcesModTimes()
+			if current == modTimes {
+				continue
+			}
+			log.Println("Map sources file changed, reloading map sources")
+		}
+		modTimes = mapSourcesModTimes()
+		if err := loadMapSources(); err != nil {
+			// Keep the previous sources, so a typo in the file does not break running downloads.
+			log.Printf("Failed to reload map sources: %v", err)
+		}
+	}
+}
+
+// mapSourcesModTimes returns a fingerprint of the modification times of the user sources files.
+func mapSourcesModTimes() string {
+	var fingerprint string
+	for _, file := range mapSourcesFiles() {
+		if info, err := os.Stat(file); err == nil {
+			fingerprint += fmt.Sprintf("%s:%d:%d;", file, info.ModTime().UnixNano(), info.Size())
+		}
+	}
+	return fingerprint
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tileStore stores the tiles of a single map style.
+type tileStore interface {
+	Has(tile Tile) bool                              // Has checks if a tile is stored.
+	Get(tile Tile) ([]byte, string, error)           // Get returns the data and format of a tile or fs.ErrNotExist.
+	Put(tile Tile, data []byte, format string) error // Put stores the data of a tile in a format (png, jpg, webp, gif or pbf).
+	Info(tile Tile) (tileInfo, error)                // Info returns the cache information of a stored tile or fs.ErrNotExist.
+	SetInfo(tile Tile, info tileInfo) error          // SetInfo stores the cache information of a stored tile.
+	Delete(tile Tile) error                          // Delete removes a tile, its cache information and missing marker.
+	Missing(tile Tile) bool                          // Missing checks if the map source is known to have no such tile.
+	SetMissing(tile Tile) error                      // SetMissing records that the map source has no such tile.
+	Walk(fn func(tile Tile) error) error             // Walk calls fn for every stored tile.
+	WalkMissing(fn func(tile Tile) error) error      // WalkMissing calls fn for every tile that is known to be missing.
+	Sync() error                                     // Sync updates derived data such as metadata after a download.
+	Close() error                                    // Close releases the resources of the store.
+}
+
+// Global variables for the tile stores.
+var (
+	storage         *string                  // Storage backend for newly downloaded map styles.
+	tileStores      = map[string]tileStore{} // Open MBTiles stores by style name.
+	tileStoresMutex sync.Mutex               // Mutex to protect access to the tileStores map.
+)
+
+// getTileStore returns the tile store of a map style.
+// A style is stored in an MBTiles file if "<style>.mbtiles" exists in the maps directory,
+// or if create is set, the style has no tile directory yet and the storage backend is mbtiles.
+// Otherwise the tiles are stored in a "<style>/z/x/y.<format>" directory tree.
+// If neither exists, tiles are read from a "<style>.pmtiles" archive unless create is set.
+func getTileStore(styleName string, create bool) (tileStore, error) {
+	tileStoresMutex.Lock()
+	defer tileStoresMutex.Unlock()
+
+	styleName = sanitizeStyleName(styleName)
+	styleCacheDir := getStyleCacheDir(styleName)
+	mbtilesPath := styleCacheDir + ".mbtiles"
+	pmtilesPath := styleCacheDir + ".pmtiles"
+	if store, ok := tileStores[styleName]; ok {
+		archive, readOnly := store.(*pmtilesStore)
+		if !readOnly {
+			return store, nil
+		}
+		// PMTiles archives are read-only, so downloads use a new tile directory instead, which then takes precedence.
+		// A replaced archive is opened again, as the cached directories describe the old one.
+		if !create && !fileExists(styleCacheDir) && !archive.replaced(pmtilesPath) {
+			return store, nil
+		}
+		if err := archive.Close(); err != nil {
+			log.Printf("Could not close tile store %s: %v", styleName, err)
+		}
+		delete(tileStores, styleName)
+	}
+
+	useMBTiles := fileExists(mbtilesPath)
+	if !useMBTiles && create && storage != nil && *storage == "mbtiles" {
+		useMBTiles = !fileExists(styleCacheDir)
+	}
+	if !useMBTiles && !create && !fileExists(styleCacheDir) && fileExists(pmtilesPath) {
+		store, err := openPMTilesStore(pmtilesPath)
+		if err != nil {
+			return nil, err
+		}
+		tileStores[styleName] = store
+		return store, nil
+	}
+	if !useMBTiles {
+		return &dirStore{dir: styleCacheDir}, nil
+	}
+
+	store, err := openMBTilesStore(mbtilesPath, styleName)
+	if err != nil {
+		return nil, err
+	}
+	tileStores[styleName] = store
+	return store, nil
+}
+
+// closeTileStores closes all open tile stores.
+func closeTileStores() {
+	tileStoresMutex.Lock()
+	defer tileStoresMutex.Unlock()
+	for name, store := range tileStores {
+		if err := store.Close(); err != nil {
+			log.Printf("Could not close tile store %s: %v", name, err)
+		}
+		delete(tileStores, name)
+	}
+}
+
+// tempFileSuffix ends the name of a temporary file while it is written.
+const tempFileSuffix = ".tmp"
+
+// staleTempFileAge is the age after which a temporary file is left over from a crash and not being written.
+const staleTempFileAge = time.Minute
+
+// writeFileAtomic writes a file to a temporary file first and renames it,
+// so a crash or a full disk never leaves a truncated file behind.
+// Every write has its own temporary file, so concurrent jobs writing the same file do not mix their data.
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*"+tempFileSuffix)
+	if err != nil {
+		return err
+	}
+	tmpPath := f.Name()
+	_, err = f.Write(data)
+	if err == nil {
+		// CreateTemp creates the file only readable by the owner.
+		err = f.Chmod(0644)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		if removeErr := os.Remove(tmpPath); removeErr != nil && !errors.Is(removeErr, fs.ErrNotExist) {
+			log.Printf("Could not remove temporary file: %v", removeErr)
+		}
+	}
+	return err
+}
+
+// removeTempFiles removes the temporary files that were left over by a crash in a directory tree.
+// Recent files are kept, as they may still be written by another process.
+func removeTempFiles(dir string) {
+	var removed int
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), tempFileSuffix) {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < staleTempFileAge {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			log.Printf("Could not remove temporary file: %v", err)
+			return nil
+		}
+		removed++
+		return nil
+	})
+	if err != nil {
+		log.Printf("Could not remove temporary files in %s: %v", dir, err)
+	}
+	if removed > 0 {
+		log.Printf("Removed %d temporary files left over by an interrupted download in %s", removed, dir)
+	}
+}
+
+// tileFileComplete checks if a tile file ends like a complete file of its format.
+// Only the beginning and the end of the file are read.
+func tileFileComplete(path string, format string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer func() { _ = f.Close() }()
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	// An empty vector tile has no layers, other tiles are never empty.
+	if info.Size() == 0 {
+		return format == "pbf"
+	}
+
+	head := make([]byte, min(info.Size(), 12))
+	tail := make([]byte, min(info.Size(), 16))
+	if _, err := f.ReadAt(head, 0); err != nil {
+		return false
+	}
+	if _, err := f.ReadAt(tail, info.Size()-int64(len(tail))); err != nil {
+		return false
+	}
+	// Tiles stored before the format was detected may have the wrong extension.
+	if sniffed := sniffTileFormat(head); sniffed != "" {
+		format = sniffed
+	}
+	switch format {
+	case "png":
+		return bytes.HasSuffix(tail, []byte("IEND\xaeB`\x82"))
+	case "jpg":
+		// Some encoders add padding after the end of image marker.
+		return bytes.Contains(tail, []byte("\xff\xd9"))
+	case "webp":
+		return len(head) == 12 && int64(binary.LittleEndian.Uint32(head[4:8]))+8 <= info.Size()
+	case "gif":
+		return bytes.HasSuffix(tail, []byte{0x3b})
+	default:
+		return true
+	}
+}
+
+// fileExists checks if a file or directory exists.
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// dirStore stores tiles as "z/x/y.<format>" files in a directory.
+type dirStore struct {
+	dir string
+}
+
+// path returns the file path of a tile in a format.
+func (s *dirStore) path(tile Tile, format string) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%d", tile.Z), fmt.Sprintf("%d", tile.X), fmt.Sprintf("%d.%s", tile.Y, format))
+}
+
+// find returns the file path and format of a stored tile.
+func (s *dirStore) find(tile Tile) (string, string, bool) {
+	for _, format := range tileFormats {
+		if tilePath := s.path(tile, format); fileExists(tilePath) {
+			return tilePath, format, true
+		}
+	}
+	return "", "", false
+}
+
+// Has checks if the complete file of a tile exists.
+// Partially written files, e.g. from versions that wrote tiles in place, count as missing, so they are downloaded again.
+func (s *dirStore) Has(tile Tile) bool {
+	tilePath, format, ok := s.find(tile)
+	return ok && tileFileComplete(tilePath, format)
+}
+
+// Get reads the file of a tile.
+// Tiles stored before the format was detected may have the wrong extension, so the data takes precedence.
+func (s *dirStore) Get(tile Tile) ([]byte, string, error) {
+	tilePath, format, ok := s.find(tile)
+	if !ok {
+		return nil, "", fs.ErrNotExist
+	}
+	data, err := os.ReadFile(tilePath)
+	if err != nil {
+		return nil, "", err
+	}
+	if sniffed := sniffTileFormat(data); sniffed != "" {
+		format = sniffed
+	}
+	return data, format, nil
+}
+
+// Put writes the file of a tile and removes files of the tile in other formats and its missing marker.
+func (s *dirStore) Put(tile Tile, data []byte, format string) error {
+	tilePath := s.path(tile, format)
+	if err := os.MkdirAll(filepath.Dir(tilePath), 0755); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(tilePath, data); err != nil {
+		return err
+	}
+	paths := []string{s.missingPath(tile)}
+	for _, other := range tileFormats {
+		if other != format {
+			paths = append(paths, s.path(tile, other))
+		}
+	}
+	for _, otherPath := range paths {
+		if err := os.Remove(otherPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// infoPath returns the path of the file with the cache information of a tile.
+func (s *dirStore) infoPath(tile Tile) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%d", tile.Z), fmt.Sprintf("%d", tile.X), fmt.Sprintf("%d.info", tile.Y))
+}
+
+// Info returns the cache information of a tile from its info file.
+// Without an info file, the modification time of the tile file is the download time.
+func (s *dirStore) Info(tile Tile) (tileInfo, error) {
+	tilePath, _, ok := s.find(tile)
+	if !ok {
+		return tileInfo{}, fs.ErrNotExist
+	}
+	var info tileInfo
+	data, err := os.ReadFile(s.infoPath(tile))
+	if err == nil {
+		if err := json.Unmarshal(data, &info); err != nil {
+			log.Printf("Ignoring invalid cache information of tile %v: %v", tile, err)
+			info = tileInfo{}
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return tileInfo{}, err
+	}
+	if info.Fetched.IsZero() {
+		stat, err := os.Stat(tilePath)
+		if err != nil {
+			return tileInfo{}, err
+		}
+		info.Fetched = stat.ModTime()
+	}
+	return info, nil
+}
+
+// SetInfo sets the modification time of a tile file to the download time.
+// The other cache information is only written to an info file if the server sent any.
+func (s *dirStore) SetInfo(tile Tile, info tileInfo) error {
+	tilePath, _, ok := s.find(tile)
+	if !ok {
+		return fs.ErrNotExist
+	}
+	if err := os.Chtimes(tilePath, info.Fetched, info.Fetched); err != nil {
+		return err
+	}
+	if info.Expires.IsZero() && !info.hasValidators() {
+		if err := os.Remove(s.infoPath(tile)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.infoPath(tile), data)
+}
+
+// missingPath returns the path of the empty marker file of a tile that the map source does not have.
+func (s *dirStore) missingPath(tile Tile) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%d", tile.Z), fmt.Sprintf("%d", tile.X), fmt.Sprintf("%d.missing", tile.Y))
+}
+
+// Missing checks if the marker file of a missing tile exists.
+func (s *dirStore) Missing(tile Tile) bool {
+	return fileExists(s.missingPath(tile))
+}
+
+// SetMissing creates the marker file of a missing tile.
+func (s *dirStore) SetMissing(tile Tile) error {
+	markerPath := s.missingPath(tile)
+	if err := os.MkdirAll(filepath.Dir(markerPath), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(markerPath, nil, 0644)
+}
+
+// Delete removes the files of a tile in all formats, its info file and its missing marker.
+func (s *dirStore) Delete(tile Tile) error {
+	paths := []string{s.infoPath(tile), s.missingPath(tile)}
+	for _, format := range tileFormats {
+		paths = append(paths, s.path(tile, format))
+	}
+	for _, tilePath := range paths {
+		if err := os.Remove(tilePath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Walk calls fn for every tile file in the directory.
+func (s *dirStore) Walk(fn func(tile Tile) error) error {
+	return s.walkFiles(tileFormats, fn)
+}
+
+// WalkMissing calls fn for every marker file of a missing tile in the directory.
+func (s *dirStore) WalkMissing(fn func(tile Tile) error) error {
+	err := s.walkFiles([]string{"missing"}, fn)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// walkFiles calls fn for every "z/x/y.<ext>" file in the directory with one of the extensions.
+func (s *dirStore) walkFiles(extensions []string, fn func(tile Tile) error) error {
+	return filepath.Walk(s.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if ext := filepath.Ext(info.Name()); !info.IsDir() && slices.Contains(extensions, strings.TrimPrefix(ext, ".")) {
+			parts := strings.Split(strings.TrimSuffix(path, ext), string(filepath.Separator))
+			if len(parts) >= 4 {
+				z, zErr := strToUint32(parts[len(parts)-3])
+				x, xErr := strToUint32(parts[len(parts)-2])
+				y, yErr := strToUint32(parts[len(parts)-1])
+				if zErr == nil && xErr == nil && yErr == nil {
+					return fn(Tile{X: x, Y: y, Z: z})
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// Sync does nothing as a directory has no metadata.
+func (s *dirStore) Sync() error {
+	return nil
+}
+
+// Close does nothing as a directory holds no resources.
+func (s *dirStore) Close() error {
+	return nil
+}
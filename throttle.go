@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultThrottleDelay    = 10 * time.Second // The pause after a 429 or 503 response without Retry-After.
+	maxRetryAfter           = 10 * time.Minute // The longest pause requested with Retry-After that is honoured.
+	maxSlowdown             = 16               // The maximum factor by which a throttled job is slowed down.
+	recoverAfter            = 50               // The number of successful requests after which the slowdown is halved.
+	circuitBreakerThreshold = 5                // The number of consecutive 403 or 429 responses that pause the job.
+	circuitBreakerPause     = 5 * time.Minute  // The first pause of the circuit breaker, doubled every time it opens again.
+	maxCircuitBreakerPause  = time.Hour        // The longest pause of the circuit breaker.
+)
+
+// throttle slows down all workers of a download job when the tile server asks for it.
+// 429 and 503 responses pause all requests for the Retry-After time and slow the job down.
+// Repeated 403 and 429 responses open a circuit breaker that pauses the job for several minutes.
+// After a pause, 403 responses without Retry-After fail their tiles instead.
+type throttle struct {
+	mutex     sync.Mutex
+	msgChan   chan<- WSMessage // Receives the messages when the job is paused and resumed.
+	until     time.Time        // No requests are sent before this time.
+	slowdown  int              // The factor by which the rate limit is divided.
+	successes int              // The number of successful requests since the last slowdown.
+	refused   int              // The number of consecutive 403 and 429 responses.
+	pauses    int              // The number of times the circuit breaker opened.
+	paused    bool             // Whether the circuit breaker is open.
+}
+
+// newThrottle returns a throttle that sends pause and resume messages to msgChan.
+func newThrottle(msgChan chan<- WSMessage) *throttle {
+	return &throttle{msgChan: msgChan, slowdown: 1}
+}
+
+// wait blocks until requests may be sent again. It returns false if the context is cancelled.
+func (t *throttle) wait(ctx context.Context) bool {
+	for {
+		t.mutex.Lock()
+		delay := time.Until(t.until)
+		t.mutex.Unlock()
+		if delay <= 0 {
+			return ctx.Err() == nil
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return false
+		case <-timer.C:
+		}
+	}
+}
+
+// interval returns the time between two tiles for a rate limit, slowed down if the server throttled the job.
+func (t *throttle) interval(rateLimit int) time.Duration {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return time.Second / time.Duration(rateLimit) * time.Duration(t.slowdown)
+}
+
+// record updates the throttle with the status code of a tile response.
+// It reports whether a refusal is final, as the server kept refusing requests after a pause of the circuit breaker.
+func (t *throttle) record(resp *http.Response) (final bool) {
+	var msg *WSMessage
+	t.mutex.Lock()
+	now := time.Now()
+	status := resp.StatusCode
+
+	switch status {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		delay, ok := parseRetryAfter(resp.Header.Get("Retry-After"), now)
+		if !ok {
+			delay = defaultThrottleDelay
+		}
+		if until := now.Add(delay); until.After(t.until) {
+			t.until = until
+		}
+		if t.slowdown < maxSlowdown {
+			t.slowdown *= 2
+			log.Printf("The tile server returned %d, slowing down the download by a factor of %d", status, t.slowdown)
+		}
+		t.successes = 0
+	case http.StatusOK, http.StatusNotModified:
+		t.successes++
+		if t.slowdown > 1 && t.successes >= recoverAfter {
+			t.slowdown /= 2
+			t.successes = 0
+		}
+	}
+
+	switch {
+	case status == http.StatusForbidden && t.pauses > 0 && resp.Header.Get("Retry-After") == "":
+		// A server that still answers 403 after a pause does not throttle the job but forbids the requests,
+		// e.g. because of an invalid API key, so the tile fails instead of pausing the job again and again.
+		final = true
+		if t.paused && !now.Before(t.until) {
+			t.paused = false
+			msg = &WSMessage{Type: "download_resumed"}
+		}
+	case status == http.StatusForbidden || status == http.StatusTooManyRequests:
+		// Responses to requests sent before the breaker opened do not count while it is open.
+		// Once the pause is over, the breaker opens again after the next run of refusals.
+		if !t.paused || !now.Before(t.until) {
+			t.refused++
+		}
+		if t.refused >= circuitBreakerThreshold {
+			pause := min(circuitBreakerPause<<min(t.pauses, 8), maxCircuitBreakerPause) // Limit the shift to avoid an overflow.
+			t.until = now.Add(pause)
+			t.pauses++
+			t.refused = 0
+			t.paused = true
+			reason := fmt.Sprintf("The tile server refused %d requests in a row (HTTP %d)", circuitBreakerThreshold, status)
+			log.Printf("%s, pausing the download until %s", reason, t.until.Format(time.TimeOnly))
+			msg = &WSMessage{Type: "download_paused", Data: map[string]interface{}{"reason": reason, "until": t.until}}
+		}
+	default:
+		t.refused = 0
+		if t.paused {
+			t.paused = false
+			log.Printf("The tile server accepts requests again, resuming the download")
+			msg = &WSMessage{Type: "download_resumed"}
+		}
+	}
+	t.mutex.Unlock()
+
+	// Send the message without holding the mutex, as sending may block.
+	if msg != nil {
+		t.msgChan <- *msg
+	}
+	return final
+}
+
+// parseRetryAfter returns the delay of a Retry-After header, given in seconds or as an HTTP date.
+// The delay is limited to maxRetryAfter.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	var delay time.Duration
+	if seconds, err := strconv.Atoi(value); err == nil {
+		delay = time.Duration(seconds) * time.Second
+	} else if t, err := http.ParseTime(value); err == nil {
+		delay = t.Sub(now)
+	} else {
+		return 0, false
+	}
+	return max(min(delay, maxRetryAfter), 0), true
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// response returns a tile response with a status code and an optional Retry-After header.
+func response(status int, retryAfter string) *http.Response {
+	resp := &http.Response{StatusCode: status, Header: http.Header{}}
+	if retryAfter != "" {
+		resp.Header.Set("Retry-After", retryAfter)
+	}
+	return resp
+}
+
+// expirePause ends the current pause of the throttle, as if wait had returned.
+func expirePause(t *throttle) {
+	t.until = time.Now().Add(-time.Millisecond)
+}
+
+func TestThrottleCircuitBreakerReopens(t *testing.T) {
+	msgChan := make(chan WSMessage, 100)
+	th := newThrottle(msgChan)
+
+	// Every pause ends before the next request, so every run of refusals opens the breaker again.
+	var pauses []time.Duration
+	for i := 0; i < 30; i++ {
+		expirePause(th)
+		th.record(response(http.StatusTooManyRequests, "0"))
+		if len(msgChan) > 0 {
+			msg := <-msgChan
+			if msg.Type != "download_paused" {
+				t.Fatalf("refusal %d: got message %q, want download_paused", i+1, msg.Type)
+			}
+			until := msg.Data.(map[string]interface{})["until"].(time.Time)
+			pauses = append(pauses, time.Until(until).Round(time.Minute))
+		}
+	}
+
+	want := []time.Duration{5 * time.Minute, 10 * time.Minute, 20 * time.Minute, 40 * time.Minute, time.Hour, time.Hour}
+	if len(pauses) != len(want) {
+		t.Fatalf("got %d pauses %v, want %v", len(pauses), pauses, want)
+	}
+	for i := range want {
+		if pauses[i] != want[i] {
+			t.Errorf("pause %d: got %v, want %v", i+1, pauses[i], want[i])
+		}
+	}
+}
+
+func TestThrottleCircuitBreaker(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int // The status codes of the responses, 0 ends the current pause.
+		want     []string
+		paused   bool
+	}{
+		{
+			name:     "too few refusals",
+			statuses: []int{403, 403, 403, 403},
+		},
+		{
+			name:     "refusals in a row",
+			statuses: []int{403, 429, 403, 429, 403},
+			want:     []string{"download_paused"},
+			paused:   true,
+		},
+		{
+			name:     "success resets the count",
+			statuses: []int{403, 403, 403, 403, 200, 403, 403, 403, 403},
+		},
+		{
+			name:     "not found does not count as refusal",
+			statuses: []int{403, 403, 404, 403, 403, 403},
+		},
+		{
+			name:     "refusals during the pause are ignored",
+			statuses: []int{403, 403, 403, 403, 403, 403, 403, 403, 403, 403, 403},
+			want:     []string{"download_paused"},
+			paused:   true,
+		},
+		{
+			name:     "breaker reopens after the pause",
+			statuses: []int{403, 403, 403, 403, 403, 0, 403, 403, 403, 403, 403},
+			want:     []string{"download_paused", "download_paused"},
+			paused:   true,
+		},
+		{
+			name:     "success after the pause resumes",
+			statuses: []int{403, 403, 403, 403, 403, 0, 200},
+			want:     []string{"download_paused", "download_resumed"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msgChan := make(chan WSMessage, 100)
+			th := newThrottle(msgChan)
+			for _, status := range tt.statuses {
+				if status == 0 {
+					expirePause(th)
+					continue
+				}
+				th.record(response(status, "0"))
+			}
+			close(msgChan)
+			var got []string
+			for msg := range msgChan {
+				got = append(got, msg.Type)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got messages %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("got messages %v, want %v", got, tt.want)
+				}
+			}
+			if th.paused != tt.paused {
+				t.Errorf("got paused %v, want %v", th.paused, tt.paused)
+			}
+		})
+	}
+}
+
+func TestThrottleForbiddenAfterPause(t *testing.T) {
+	msgChan := make(chan WSMessage, 100)
+	th := newThrottle(msgChan)
+	steps := []struct {
+		status     int
+		retryAfter string
+		final      bool
+	}{
+		{403, "", false}, // Refusals before the first pause are retried.
+		{403, "", false},
+		{403, "", false},
+		{403, "", false},
+		{403, "", false}, // Opens the breaker.
+		{0, "", false},
+		{403, "", true}, // The server still refuses after the pause.
+		{403, "", true},
+		{403, "60", false}, // A server asking to retry later is still throttling.
+		{429, "", false},
+	}
+	for i, step := range steps {
+		if step.status == 0 {
+			expirePause(th)
+			continue
+		}
+		if got := th.record(response(step.status, step.retryAfter)); got != step.final {
+			t.Errorf("response %d (%d): got final %v, want %v", i+1, step.status, got, step.final)
+		}
+	}
+	close(msgChan)
+	var got []string
+	for msg := range msgChan {
+		got = append(got, msg.Type)
+	}
+	// The job is no longer shown as paused while its tiles fail.
+	if want := []string{"download_paused", "download_resumed"}; len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("got messages %v, want %v", got, want)
+	}
+}
+
+func TestThrottleSlowdown(t *testing.T) {
+	th := newThrottle(make(chan WSMessage, 100))
+	for i := 0; i < 10; i++ {
+		th.record(response(http.StatusServiceUnavailable, "0"))
+	}
+	if got, want := th.interval(10), 100*time.Millisecond*maxSlowdown; got != want {
+		t.Errorf("got interval %v after throttling, want %v", got, want)
+	}
+	for i := 0; i < recoverAfter; i++ {
+		th.record(response(http.StatusOK, ""))
+	}
+	if got, want := th.interval(10), 100*time.Millisecond*maxSlowdown/2; got != want {
+		t.Errorf("got interval %v after %d successes, want %v", got, recoverAfter, want)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{"", 0, false},
+		{"120", 2 * time.Minute, true},
+		{"0", 0, true},
+		{"-5", 0, true},
+		{"86400", maxRetryAfter, true},
+		{"Mon, 01 Jan 2024 12:00:30 GMT", 30 * time.Second, true},
+		{"Mon, 01 Jan 2024 11:00:00 GMT", 0, true},
+		{"soon", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseRetryAfter(tt.value, now)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("parseRetryAfter(%q) = %v, %v, want %v, %v", tt.value, got, ok, tt.want, tt.ok)
+		}
+	}
+}
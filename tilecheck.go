@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"  // GIF decoder for checking tiles.
+	_ "image/jpeg" // JPEG decoder for checking tiles.
+	_ "image/png"  // PNG decoder for checking tiles.
+	"io"
+	"mime"
+	"strings"
+)
+
+// Kinds of tile problems.
+const (
+	tileProblemEmpty       = "empty"       // The tile has no data.
+	tileProblemHTML        = "html"        // The tile is an HTML or XML page, e.g. an error page of the server.
+	tileProblemUndecodable = "undecodable" // The tile data is corrupt or truncated.
+	tileProblemSize        = "wrong size"  // The image does not have the tile size of the map source.
+
+	// Problems of downloaded tiles.
+	tileProblemContentType = "content type" // The response is not a tile, e.g. a text/html page.
+	tileProblemTooSmall    = "too small"    // The tile is smaller than the minimum size of the map source.
+	tileProblemPlaceholder = "placeholder"  // The tile is a known placeholder of the map source.
+)
+
+// tileProblems are the kinds of problems of cached tiles in the order they are reported.
+var tileProblems = []string{tileProblemEmpty, tileProblemHTML, tileProblemUndecodable, tileProblemSize}
+
+// tileProblem describes why tile data is not a valid tile.
+type tileProblem struct {
+	Kind   string // The kind of the problem.
+	Detail string // A description of the problem.
+}
+
+// Error returns the description of the problem.
+func (p *tileProblem) Error() string {
+	return p.Detail
+}
+
+// checkTile checks that tile data is a valid tile of a format (png, jpg, webp, gif or pbf).
+// Images must have tileSize × tileSize pixels unless tileSize is 0. It returns a *tileProblem for invalid data.
+func checkTile(data []byte, format string, tileSize int) error {
+	// A vector tile without layers, e.g. of the open sea, has no data.
+	if len(data) == 0 && format == "pbf" {
+		return nil
+	}
+	if len(data) == 0 {
+		return &tileProblem{Kind: tileProblemEmpty, Detail: "the tile is empty"}
+	}
+	if isMarkup(data) {
+		return &tileProblem{Kind: tileProblemHTML, Detail: "the tile is an HTML or XML page"}
+	}
+
+	var width, height int
+	switch format {
+	case "pbf":
+		if err := checkVectorTile(data); err != nil {
+			return &tileProblem{Kind: tileProblemUndecodable, Detail: fmt.Sprintf("invalid vector tile: %v", err)}
+		}
+		return nil
+	case "webp":
+		var err error
+		if width, height, err = webpSize(data); err != nil {
+			return &tileProblem{Kind: tileProblemUndecodable, Detail: fmt.Sprintf("invalid WebP image: %v", err)}
+		}
+	default:
+		img, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			return &tileProblem{Kind: tileProblemUndecodable, Detail: fmt.Sprintf("invalid %s image: %v", format, err)}
+		}
+		width, height = img.Bounds().Dx(), img.Bounds().Dy()
+	}
+
+	if tileSize != 0 && (width != tileSize || height != tileSize) {
+		return &tileProblem{Kind: tileProblemSize, Detail: fmt.Sprintf("the image has %d×%d pixels instead of %d×%d", width, height, tileSize, tileSize)}
+	}
+	return nil
+}
+
+// checkTileResponse checks a downloaded tile of a format before it is stored.
+// Besides the checks of checkTile, the Content-Type header, the minimum size and the placeholders of the map source are checked.
+func checkTileResponse(contentType string, data []byte, format string, source MapSource) error {
+	if contentType != "" && !isTileContentType(contentType) {
+		return &tileProblem{Kind: tileProblemContentType, Detail: fmt.Sprintf("unexpected content type %s", contentType)}
+	}
+	if len(data) > 0 && len(data) < source.MinBytes {
+		return &tileProblem{Kind: tileProblemTooSmall, Detail: fmt.Sprintf("the tile has %d bytes, less than %d", len(data), source.MinBytes)}
+	}
+	if len(source.Placeholders) > 0 {
+		hash := sha256.Sum256(data)
+		for _, placeholder := range source.Placeholders {
+			if strings.EqualFold(placeholder, hex.EncodeToString(hash[:])) {
+				return &tileProblem{Kind: tileProblemPlaceholder, Detail: "the tile is a placeholder of the map source"}
+			}
+		}
+	}
+	return checkTile(data, format, source.TileSize)
+}
+
+// isTileContentType checks if a Content-Type header can be the one of a tile.
+// Servers that do not know the type of a tile send application/octet-stream.
+func isTileContentType(contentType string) bool {
+	if contentTypeTileFormat(contentType) != "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	mediaType = strings.ToLower(mediaType)
+	return strings.HasPrefix(mediaType, "image/") || mediaType == "application/octet-stream" || mediaType == "binary/octet-stream"
+}
+
+// isMarkup checks if data looks like an HTML or XML document.
+func isMarkup(data []byte) bool {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	data = bytes.TrimLeft(data, " \t\r\n")
+	prefix := bytes.ToLower(data[:min(len(data), 9)])
+	return bytes.HasPrefix(prefix, []byte("<!doctype")) || bytes.HasPrefix(prefix, []byte("<html")) ||
+		bytes.HasPrefix(prefix, []byte("<?xml")) || bytes.HasPrefix(prefix, []byte("<head")) || bytes.HasPrefix(prefix, []byte("<body"))
+}
+
+// checkVectorTile checks that data is a complete gzip stream or starts with a layer of the vector tile format.
+func checkVectorTile(data []byte) error {
+	if sniffTileFormat(data) == "pbf" {
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		if data, err = io.ReadAll(r); err != nil {
+			return err
+		}
+		if len(data) == 0 {
+			return nil
+		}
+	}
+	// Every message of a vector tile is a layer (field 3, length-delimited).
+	if data[0] != 0x1a {
+		return errors.New("no vector tile layer")
+	}
+	return nil
+}
+
+// webpSize returns the size of a WebP image from its header.
+func webpSize(data []byte) (int, int, error) {
+	if len(data) < 30 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return 0, 0, errors.New("no WebP header")
+	}
+	if size := int(binary.LittleEndian.Uint32(data[4:8])) + 8; size > len(data) {
+		return 0, 0, fmt.Errorf("truncated to %d of %d bytes", len(data), size)
+	}
+	switch string(data[12:16]) {
+	case "VP8 ":
+		if !bytes.Equal(data[23:26], []byte{0x9d, 0x01, 0x2a}) {
+			return 0, 0, errors.New("invalid VP8 frame")
+		}
+		return int(binary.LittleEndian.Uint16(data[26:28]) & 0x3fff), int(binary.LittleEndian.Uint16(data[28:30]) & 0x3fff), nil
+	case "VP8L":
+		if data[20] != 0x2f {
+			return 0, 0, errors.New("invalid VP8L signature")
+		}
+		bits := binary.LittleEndian.Uint32(data[21:25])
+		return int(bits&0x3fff) + 1, int(bits>>14&0x3fff) + 1, nil
+	case "VP8X":
+		width := int(data[24]) | int(data[25])<<8 | int(data[26])<<16
+		height := int(data[27]) | int(data[28])<<8 | int(data[29])<<16
+		return width + 1, height + 1, nil
+	default:
+		return 0, 0, fmt.Errorf("unknown chunk %q", data[12:16])
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"image/gif"
+	"testing"
+)
+
+// encodeTestGIF returns a synthetic tile encoded as GIF.
+func encodeTestGIF(t *testing.T, tile Tile) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := gif.Encode(&buf, mockTileImage(tile, 256), nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// gzipTestData returns data compressed with gzip.
+func gzipTestData(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// webpTestHeader returns the header of a lossless WebP image with a size.
+func webpTestHeader(width, height int) []byte {
+	data := []byte("RIFF\x00\x00\x00\x00WEBPVP8L\x00\x00\x00\x00\x2f")
+	data = binary.LittleEndian.AppendUint32(data, uint32(width-1)|uint32(height-1)<<14)
+	data = append(data, make([]byte, 10)...)
+	binary.LittleEndian.PutUint32(data[4:8], uint32(len(data)-8))
+	return data
+}
+
+func TestCheckTile(t *testing.T) {
+	tile := Tile{X: 1, Y: 2, Z: 3}
+	png := encodeTestTile(t, tile, "png")
+	layer := []byte("\x1a\x05\x0a\x03sea") // A vector tile with an empty layer named "sea".
+	tests := []struct {
+		name     string
+		data     []byte
+		format   string
+		tileSize int
+		problem  string // The kind of problem, "" for a valid tile.
+	}{
+		{"png", png, "png", 256, ""},
+		{"jpg", encodeTestTile(t, tile, "jpg"), "jpg", 256, ""},
+		{"gif", encodeTestGIF(t, tile), "gif", 256, ""},
+		{"webp", webpTestHeader(256, 256), "webp", 256, ""},
+		{"any size", png, "png", 0, ""},
+		{"wrong size", png, "png", 512, tileProblemSize},
+		{"wrong webp size", webpTestHeader(512, 512), "webp", 256, tileProblemSize},
+		{"truncated png", png[:len(png)/2], "png", 256, tileProblemUndecodable},
+		{"truncated webp", webpTestHeader(256, 256)[:20], "webp", 256, tileProblemUndecodable},
+		{"empty png", nil, "png", 256, tileProblemEmpty},
+		{"html", []byte("\n<!DOCTYPE html><html><body>Not found</body></html>"), "png", 256, tileProblemHTML},
+		{"xml", []byte("<?xml version=\"1.0\"?><ServiceExceptionReport/>"), "jpg", 256, tileProblemHTML},
+		{"vector tile", layer, "pbf", 256, ""},
+		{"compressed vector tile", gzipTestData(t, layer), "pbf", 256, ""},
+		{"empty vector tile", nil, "pbf", 256, ""},
+		{"compressed empty vector tile", gzipTestData(t, nil), "pbf", 256, ""},
+		{"no vector tile", []byte("garbage"), "pbf", 256, tileProblemUndecodable},
+		{"truncated vector tile", gzipTestData(t, layer)[:10], "pbf", 256, tileProblemUndecodable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkTile(tt.data, tt.format, tt.tileSize)
+			var problem *tileProblem
+			switch {
+			case tt.problem == "" && err != nil:
+				t.Errorf("got error %v, want a valid tile", err)
+			case tt.problem != "" && !errors.As(err, &problem):
+				t.Errorf("got error %v, want a %s problem", err, tt.problem)
+			case tt.problem != "" && problem.Kind != tt.problem:
+				t.Errorf("got a %s problem (%v), want a %s problem", problem.Kind, err, tt.problem)
+			}
+		})
+	}
+}
+
+func TestCheckTileResponse(t *testing.T) {
+	tile := Tile{X: 1, Y: 2, Z: 3}
+	png := encodeTestTile(t, tile, "png")
+	hash := sha256.Sum256(png)
+	tests := []struct {
+		name        string
+		contentType string
+		data        []byte
+		source      MapSource
+		problem     string // The kind of problem, "" for a valid tile.
+	}{
+		{"png", "image/png", png, MapSource{}, ""},
+		{"gif", "image/gif", encodeTestGIF(t, tile), MapSource{Format: "gif"}, ""},
+		{"no content type", "", png, MapSource{}, ""},
+		{"octet stream", "application/octet-stream", png, MapSource{}, ""},
+		{"error page", "text/html; charset=utf-8", png, MapSource{}, tileProblemContentType},
+		{"too small", "image/png", png, MapSource{MinBytes: len(png) + 1}, tileProblemTooSmall},
+		{"placeholder", "image/png", png, MapSource{Placeholders: []string{hex.EncodeToString(hash[:])}}, tileProblemPlaceholder},
+		{"empty vector tile", "application/x-protobuf", nil, MapSource{Format: "pbf"}, ""},
+		{"empty vector tile of an unknown type", "", nil, MapSource{Format: "pbf"}, ""},
+		{"empty image", "image/png", nil, MapSource{Format: "pbf"}, tileProblemEmpty},
+		{"empty tile", "", nil, MapSource{}, tileProblemEmpty},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := tt.source.withDefaults()
+			format := responseTileFormat(tt.contentType, tt.data, source.Format)
+			err := checkTileResponse(tt.contentType, tt.data, format, source)
+			var problem *tileProblem
+			switch {
+			case tt.problem == "" && err != nil:
+				t.Errorf("got error %v, want a valid tile", err)
+			case tt.problem != "" && !errors.As(err, &problem):
+				t.Errorf("got error %v, want a %s problem", err, tt.problem)
+			case tt.problem != "" && problem.Kind != tt.problem:
+				t.Errorf("got a %s problem (%v), want a %s problem", problem.Kind, err, tt.problem)
+			}
+		})
+	}
+}
+
+func TestResponseTileFormat(t *testing.T) {
+	tile := Tile{X: 1, Y: 2, Z: 3}
+	tests := []struct {
+		name        string
+		contentType string
+		data        []byte
+		declared    string
+		want        string
+	}{
+		{"png data", "image/jpeg", encodeTestTile(t, tile, "png"), "jpg", "png"},
+		{"jpg data", "", encodeTestTile(t, tile, "jpg"), "", "jpg"},
+		{"gif data", "application/octet-stream", encodeTestGIF(t, tile), "", "gif"},
+		{"gif content type", "image/gif", []byte("unknown"), "png", "gif"},
+		{"uncompressed vector tile", "application/vnd.mapbox-vector-tile", []byte("\x1a\x00"), "", "pbf"},
+		{"declared format", "application/octet-stream", []byte("\x1a\x00"), "pbf", "pbf"},
+		{"unknown", "", []byte("unknown"), "", "png"},
+	}
+	for _, tt := range tests {
+		if got := responseTileFormat(tt.contentType, tt.data, tt.declared); got != tt.want {
+			t.Errorf("%s: got format %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTileFileComplete(t *testing.T) {
+	tile := Tile{X: 1, Y: 2, Z: 3}
+	png := encodeTestTile(t, tile, "png")
+	gifData := encodeTestGIF(t, tile)
+	store := &dirStore{dir: t.TempDir()}
+	tests := []struct {
+		name   string
+		data   []byte
+		format string
+		want   bool
+	}{
+		{"png", png, "png", true},
+		{"truncated png", png[:len(png)-10], "png", false},
+		{"gif", gifData, "gif", true},
+		{"truncated gif", gifData[:len(gifData)-10], "gif", false},
+		{"empty png", nil, "png", false},
+		{"empty vector tile", nil, "pbf", true},
+	}
+	for i, tt := range tests {
+		tile := Tile{X: uint32(i), Y: 0, Z: 5}
+		if err := store.Put(tile, tt.data, tt.format); err != nil {
+			t.Fatal(err)
+		}
+		if got := store.Has(tile); got != tt.want {
+			t.Errorf("%s: got complete %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"mime"
+	"strings"
+)
+
+// tileFormats are the formats tiles are stored in, in the order their files are looked up.
+var tileFormats = []string{"png", "jpg", "webp", "gif", "pbf"}
+
+// detectTileFormat returns the image format of tile data as used in MBTiles metadata.
+func detectTileFormat(data []byte) string {
+	if format := sniffTileFormat(data); format != "" {
+		return format
+	}
+	return "png"
+}
+
+// sniffTileFormat returns the format of tile data from its magic bytes, or "" if it is unknown.
+// Vector tiles are only recognized if they are gzip compressed.
+func sniffTileFormat(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return "png"
+	case bytes.HasPrefix(data, []byte("\xff\xd8\xff")):
+		return "jpg"
+	case len(data) >= 12 && bytes.Equal(data[0:4], []byte("RIFF")) && bytes.Equal(data[8:12], []byte("WEBP")):
+		return "webp"
+	case bytes.HasPrefix(data, []byte("GIF87a")) || bytes.HasPrefix(data, []byte("GIF89a")):
+		return "gif"
+	case bytes.HasPrefix(data, []byte("\x1f\x8b")):
+		return "pbf"
+	default:
+		return ""
+	}
+}
+
+// contentTypeTileFormat returns the tile format of a Content-Type header, or "" if it is unknown.
+func contentTypeTileFormat(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	switch strings.ToLower(mediaType) {
+	case "image/png", "image/x-png":
+		return "png"
+	case "image/jpeg", "image/jpg", "image/pjpeg":
+		return "jpg"
+	case "image/webp":
+		return "webp"
+	case "image/gif":
+		return "gif"
+	case "application/x-protobuf", "application/vnd.mapbox-vector-tile", "application/vnd.mvt", "application/protobuf":
+		return "pbf"
+	default:
+		return ""
+	}
+}
+
+// responseTileFormat returns the format of a downloaded tile.
+// The magic bytes of the data take precedence over the Content-Type header,
+// which takes precedence over the format declared by the map source.
+func responseTileFormat(contentType string, data []byte, declared string) string {
+	if format := sniffTileFormat(data); format != "" {
+		return format
+	}
+	if format := contentTypeTileFormat(contentType); format != "" {
+		return format
+	}
+	if declared != "" {
+		return declared
+	}
+	return "png"
+}
+
+// tileFormatContentType returns the Content-Type header for serving tiles of a format.
+func tileFormatContentType(format string) string {
+	switch format {
+	case "jpg":
+		return "image/jpeg"
+	case "webp":
+		return "image/webp"
+	case "gif":
+		return "image/gif"
+	case "pbf":
+		return "application/x-protobuf"
+	default:
+		return "image/png"
+	}
+}
+
+// tileFormatAccept returns the Accept header for tiles of a format declared by a map source.
+func tileFormatAccept(format string) string {
+	switch format {
+	case "png":
+		return "image/png"
+	case "jpg":
+		return "image/jpeg"
+	case "webp":
+		return "image/webp"
+	case "gif":
+		return "image/gif"
+	case "pbf":
+		return "application/x-protobuf"
+	default:
+		return "image/*"
+	}
+}
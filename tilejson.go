@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// tileJSON is the part of a TileJSON document that is needed to import a map source.
+type tileJSON struct {
+	Name         string            `json:"name"`
+	Attribution  string            `json:"attribution"`
+	Tiles        []string          `json:"tiles"`
+	MinZoom      *int              `json:"minzoom"`
+	MaxZoom      *int              `json:"maxzoom"`
+	Bounds       []float64         `json:"bounds"`
+	Scheme       string            `json:"scheme"`
+	Format       string            `json:"format"`
+	VectorLayers []json.RawMessage `json:"vector_layers"`
+}
+
+// parseTileJSON returns the map source and the name of a TileJSON document.
+// Relative tile URLs are resolved against the location of the document.
+func parseTileJSON(data []byte, location string) (string, MapSource, error) {
+	var doc tileJSON
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return "", MapSource{}, fmt.Errorf("invalid TileJSON: %w", err)
+	}
+	if len(doc.Tiles) == 0 {
+		return "", MapSource{}, errors.New("TileJSON has no tile URLs")
+	}
+
+	tiles := make([]string, len(doc.Tiles))
+	for i, tile := range doc.Tiles {
+		tiles[i] = resolveTileURL(tile, location)
+	}
+	source := MapSource{
+		URL:         mergeTileURLs(tiles),
+		Attribution: doc.Attribution,
+		Bounds:      doc.Bounds,
+		Format:      tileJSONFormat(doc, tiles[0]),
+	}
+	// TMS sources count the rows from the south.
+	if doc.Scheme == "tms" {
+		source.URL = strings.ReplaceAll(source.URL, "{y}", "{-y}")
+	}
+	if doc.MinZoom != nil {
+		source.MinZoom = *doc.MinZoom
+	}
+	if doc.MaxZoom != nil {
+		maxZoom := min(*doc.MaxZoom, maxSourceZoom)
+		source.MaxZoom = &maxZoom
+	}
+	// Bounds that cover the whole world are the same as no bounds.
+	if len(source.Bounds) == 4 && source.Bounds[0] <= -180 && source.Bounds[1] <= -85 && source.Bounds[2] >= 180 && source.Bounds[3] >= 85 {
+		source.Bounds = nil
+	}
+	if err := validateMapSource(source); err != nil {
+		return "", MapSource{}, err
+	}
+	return doc.Name, source, nil
+}
+
+// resolveTileURL resolves a tile URL template of a TileJSON document against the location of the document.
+func resolveTileURL(tile, location string) string {
+	base, err := url.Parse(location)
+	if err != nil || base.Scheme == "" || strings.Contains(tile, "://") {
+		return tile
+	}
+	// Keep the braces of the placeholders, which the URL parser would escape.
+	ref, err := url.Parse(tile)
+	if err != nil {
+		return tile
+	}
+	resolved, err := url.PathUnescape(base.ResolveReference(ref).String())
+	if err != nil {
+		return tile
+	}
+	return resolved
+}
+
+// mergeTileURLs returns a URL template for the tile URLs of a TileJSON document.
+// URLs that only differ in one part, e.g. the server name, are merged with a {switch:...} placeholder.
+func mergeTileURLs(tiles []string) string {
+	if len(tiles) == 1 {
+		return tiles[0]
+	}
+	prefix, suffix := tiles[0], tiles[0]
+	for _, tile := range tiles[1:] {
+		for !strings.HasPrefix(tile, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+		for !strings.HasSuffix(tile, suffix) {
+			suffix = suffix[1:]
+		}
+	}
+	var values []string
+	for _, tile := range tiles {
+		if len(prefix)+len(suffix) > len(tile) {
+			return tiles[0]
+		}
+		value := tile[len(prefix) : len(tile)-len(suffix)]
+		if value == "" || strings.ContainsAny(value, "{},") {
+			return tiles[0]
+		}
+		values = append(values, value)
+	}
+	return prefix + switchPrefix + strings.Join(values, ",") + "}" + suffix
+}
+
+// tileJSONFormat returns the tile format of a TileJSON document from its format, vector layers or tile URL.
+func tileJSONFormat(doc tileJSON, tile string) string {
+	format := strings.ToLower(doc.Format)
+	if format == "" {
+		if u, err := url.Parse(tile); err == nil {
+			format = strings.TrimPrefix(strings.ToLower(path.Ext(u.Path)), ".")
+		}
+	}
+	switch format {
+	case "png", "webp", "gif", "pbf":
+		return format
+	case "jpg", "jpeg":
+		return "jpg"
+	case "mvt":
+		return "pbf"
+	}
+	if len(doc.VectorLayers) > 0 {
+		return "pbf"
+	}
+	return ""
+}
+
+// importTileJSON adds the map source of a TileJSON document to the user sources file of the maps directory.
+// The name of the document is used if no name is given. It returns the name and the map source.
+func importTileJSON(location, name string) (string, MapSource, error) {
+	data, err := fetchDocument(location)
+	if err != nil {
+		return "", MapSource{}, fmt.Errorf("could not read TileJSON: %w", err)
+	}
+	docName, source, err := parseTileJSON(data, location)
+	if err != nil {
+		return "", MapSource{}, fmt.Errorf("%w: %v", errInvalidSource, err)
+	}
+	if name == "" {
+		name = docName
+	}
+	if err := putUserSource(name, source, true); err != nil {
+		return "", MapSource{}, err
+	}
+	return name, source, nil
+}
+
+// runImportTileJSONCommand imports a map source from a TileJSON document and returns the exit code.
+func runImportTileJSONCommand(args []string) int {
+	fs := flag.NewFlagSet("import-tilejson", flag.ExitOnError)
+	registerCacheDirFlag(fs)
+	registerSourcesFlag(fs)
+	registerHTTPClientFlags(fs)
+	location := fs.String("tilejson", "", "File or URL of the TileJSON document")
+	name := fs.String("name", "", "Name of the map source (default: name of the TileJSON document)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s import-tilejson [options]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *location == "" {
+		log.Print("No TileJSON document given")
+		return 2
+	}
+	if err := configureHTTPClient(); err != nil {
+		log.Print(err)
+		return 2
+	}
+	if err := loadMapSources(); err != nil {
+		log.Printf("Failed to load map sources: %v", err)
+		return 1
+	}
+	if err := os.MkdirAll(*cacheDir, 0755); err != nil {
+		log.Printf("Failed to create maps directory: %v", err)
+		return 1
+	}
+
+	imported, source, err := importTileJSON(*location, *name)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	fmt.Printf("Imported map source %q: %s, zoom %d-%d\n", imported, source.URL, source.MinZoom, source.maxZoom())
+	return 0
+}
+
+// apiImportTileJSON imports a map source from a TileJSON document.
+func apiImportTileJSON(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		TileJSON string `json:"tilejson"` // The URL of the TileJSON document.
+		Name     string `json:"name"`     // The name of the map source.
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid import request")
+		return
+	}
+	if !strings.HasPrefix(req.TileJSON, "http://") && !strings.HasPrefix(req.TileJSON, "https://") {
+		writeJSONError(w, http.StatusBadRequest, "The TileJSON must be an http or https URL")
+		return
+	}
+
+	name, source, err := importTileJSON(req.TileJSON, req.Name)
+	writeSourceResult(w, http.StatusCreated, apiSource{Name: name, MapSource: source}, err)
+}
@@ -0,0 +1,87 @@
+package main
+
+import "testing"
+
+func TestParseTileJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		doc     string
+		url     string
+		minZoom int
+		maxZoom int
+		format  string
+		valid   bool
+	}{
+		{
+			name:    "default zoom levels",
+			doc:     `{"tiles": ["https://tiles.example.com/{z}/{x}/{y}.png"]}`,
+			url:     "https://tiles.example.com/{z}/{x}/{y}.png",
+			maxZoom: defaultSourceMaxZoom,
+			format:  "png",
+			valid:   true,
+		},
+		{
+			name:    "zoom level 0 only",
+			doc:     `{"tiles": ["https://tiles.example.com/{z}/{x}/{y}.png"], "minzoom": 0, "maxzoom": 0}`,
+			url:     "https://tiles.example.com/{z}/{x}/{y}.png",
+			maxZoom: 0,
+			format:  "png",
+			valid:   true,
+		},
+		{
+			name:    "max zoom above the limit",
+			doc:     `{"tiles": ["https://tiles.example.com/{z}/{x}/{y}.pbf"], "minzoom": 2, "maxzoom": 30}`,
+			url:     "https://tiles.example.com/{z}/{x}/{y}.pbf",
+			minZoom: 2,
+			maxZoom: maxSourceZoom,
+			format:  "pbf",
+			valid:   true,
+		},
+		{
+			name: "max zoom below min zoom",
+			doc:  `{"tiles": ["https://tiles.example.com/{z}/{x}/{y}.png"], "minzoom": 5, "maxzoom": 3}`,
+		},
+		{
+			name:    "tms scheme and relative URLs",
+			doc:     `{"tiles": ["tiles/{z}/{x}/{y}.jpg"], "scheme": "tms", "maxzoom": 12}`,
+			url:     "https://example.com/map/tiles/{z}/{x}/{-y}.jpg",
+			maxZoom: 12,
+			format:  "jpg",
+			valid:   true,
+		},
+		{
+			name:    "several servers",
+			doc:     `{"tiles": ["https://a.example.com/{z}/{x}/{y}.png", "https://b.example.com/{z}/{x}/{y}.png"]}`,
+			url:     "https://{switch:a,b}.example.com/{z}/{x}/{y}.png",
+			maxZoom: defaultSourceMaxZoom,
+			format:  "png",
+			valid:   true,
+		},
+		{
+			name: "no tiles",
+			doc:  `{"name": "empty"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, source, err := parseTileJSON([]byte(tt.doc), "https://example.com/map/tiles.json")
+			if (err == nil) != tt.valid {
+				t.Fatalf("got error %v, want valid: %v", err, tt.valid)
+			}
+			if err != nil {
+				return
+			}
+			if source.URL != tt.url {
+				t.Errorf("got URL %s, want %s", source.URL, tt.url)
+			}
+			// The zoom levels must survive the defaults that are filled in when the source is used.
+			source = source.withDefaults()
+			if source.MinZoom != tt.minZoom || source.maxZoom() != tt.maxZoom {
+				t.Errorf("got zoom levels %d-%d, want %d-%d", source.MinZoom, source.maxZoom(), tt.minZoom, tt.maxZoom)
+			}
+			if source.Format != tt.format {
+				t.Errorf("got format %q, want %q", source.Format, tt.format)
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// urlPlaceholder matches a placeholder in a tile URL template.
+var urlPlaceholder = regexp.MustCompile(`\{[^{}]*\}`)
+
+// urlPlaceholders are the built-in placeholders of tile URL templates.
+// {switch:a,b,c} and the variables of a map source are placeholders as well.
+var urlPlaceholders = map[string]bool{
+	"{s}":              true, // One of the subdomains of the source.
+	"{z}":              true, // Zoom level.
+	"{x}":              true, // Tile column.
+	"{y}":              true, // Tile row, counted from the north (XYZ).
+	"{-y}":             true, // Tile row, counted from the south (TMS).
+	"{quadkey}":        true, // Bing Maps quadkey of the tile.
+	"{r}":              true, // "@2x" for sources with 512 pixel tiles, otherwise empty.
+	"{bbox}":           true, // Bounds of the tile in EPSG:3857 as minX,minY,maxX,maxY.
+	"{bbox-epsg-3857}": true, // Same as {bbox}.
+	"{bbox-epsg-4326}": true, // Bounds of the tile in degrees as west,south,east,north.
+}
+
+// switchPrefix starts a placeholder with a custom list of values, e.g. {switch:a,b,c}.
+const switchPrefix = "{switch:"
+
+// validateURLTemplate checks that a tile URL template is an HTTP(S) URL with known placeholders
+// that identify the tile: {z} with {x} and {y} or {-y}, {quadkey} or one of the {bbox} placeholders.
+func validateURLTemplate(urlTemplate string, variables map[string]string) error {
+	has := make(map[string]bool)
+	for _, placeholder := range urlPlaceholder.FindAllString(urlTemplate, -1) {
+		switch {
+		case urlPlaceholders[placeholder]:
+		case strings.HasPrefix(placeholder, switchPrefix):
+			for _, value := range switchValues(placeholder) {
+				if value == "" {
+					return fmt.Errorf("empty value in %s", placeholder)
+				}
+			}
+		case hasVariable(variables, placeholder):
+		default:
+			return fmt.Errorf("unknown placeholder %s in URL template", placeholder)
+		}
+		has[placeholder] = true
+	}
+
+	xyz := has["{z}"] && has["{x}"] && (has["{y}"] || has["{-y}"])
+	bbox := has["{bbox}"] || has["{bbox-epsg-3857}"] || has["{bbox-epsg-4326}"]
+	if !xyz && !has["{quadkey}"] && !bbox {
+		return errors.New("URL template must contain {z}, {x} and {y} or {-y}, or {quadkey}, or {bbox}")
+	}
+
+	u, err := url.Parse(urlPlaceholder.ReplaceAllString(urlTemplate, "0"))
+	if err != nil {
+		return fmt.Errorf("invalid URL template: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("URL template must be an http or https URL")
+	}
+	return nil
+}
+
+// hasVariable checks if a placeholder is a variable of a map source.
+func hasVariable(variables map[string]string, placeholder string) bool {
+	_, ok := variables[strings.Trim(placeholder, "{}")]
+	return ok
+}
+
+// switchValues returns the values of a {switch:a,b,c} placeholder.
+func switchValues(placeholder string) []string {
+	return strings.Split(strings.TrimSuffix(strings.TrimPrefix(placeholder, switchPrefix), "}"), ",")
+}
+
+// tileURL returns the URL of a tile from the URL template of the map source.
+// Subdomains are chosen by the tile position, so a tile is always requested from the same server.
+func (s MapSource) tileURL(tile Tile) string {
+	return urlPlaceholder.ReplaceAllStringFunc(s.URL, func(placeholder string) string {
+		switch placeholder {
+		case "{s}":
+			return pickValue(s.Subdomains, tile)
+		case "{z}":
+			return strconv.FormatUint(uint64(tile.Z), 10)
+		case "{x}":
+			return strconv.FormatUint(uint64(tile.X), 10)
+		case "{y}":
+			return strconv.FormatUint(uint64(tile.Y), 10)
+		case "{-y}":
+			return strconv.FormatUint(uint64(1)<<tile.Z-1-uint64(tile.Y), 10)
+		case "{quadkey}":
+			return tileQuadkey(tile)
+		case "{r}":
+			if s.TileSize == 512 {
+				return "@2x"
+			}
+			return ""
+		case "{bbox}", "{bbox-epsg-3857}":
+			minX, minY, maxX, maxY := tileMercatorBounds(tile)
+			return formatBBox(minX, minY, maxX, maxY)
+		case "{bbox-epsg-4326}":
+			bounds := tileBounds(tile)
+			return formatBBox(bounds.West, bounds.South, bounds.East, bounds.North)
+		}
+		if strings.HasPrefix(placeholder, switchPrefix) {
+			return pickValue(switchValues(placeholder), tile)
+		}
+		if value, ok := s.Variables[strings.Trim(placeholder, "{}")]; ok {
+			return value
+		}
+		return placeholder
+	})
+}
+
+// pickValue returns one of the values for a tile, the same way Leaflet picks subdomains.
+func pickValue(values []string, tile Tile) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[(uint64(tile.X)+uint64(tile.Y))%uint64(len(values))]
+}
+
+// tileQuadkey returns the Bing Maps quadkey of a tile.
+func tileQuadkey(tile Tile) string {
+	var b strings.Builder
+	for i := tile.Z; i > 0; i-- {
+		digit := '0'
+		mask := uint32(1) << (i - 1)
+		if tile.X&mask != 0 {
+			digit++
+		}
+		if tile.Y&mask != 0 {
+			digit += 2
+		}
+		b.WriteRune(digit)
+	}
+	return b.String()
+}
+
+// earthCircumference is the circumference of the earth in EPSG:3857 meters.
+const earthCircumference = 2 * math.Pi * 6378137
+
+// tileMercatorBounds returns the bounds of a tile in EPSG:3857 meters.
+func tileMercatorBounds(tile Tile) (minX, minY, maxX, maxY float64) {
+	n := math.Pow(2, float64(tile.Z))
+	minX = earthCircumference * (float64(tile.X)/n - 0.5)
+	maxX = earthCircumference * (float64(tile.X+1)/n - 0.5)
+	minY = earthCircumference * (0.5 - float64(tile.Y+1)/n)
+	maxY = earthCircumference * (0.5 - float64(tile.Y)/n)
+	return minX, minY, maxX, maxY
+}
+
+// formatBBox formats the bounds of a tile for a URL.
+func formatBBox(minX, minY, maxX, maxY float64) string {
+	return strings.Join([]string{
+		strconv.FormatFloat(minX, 'f', -1, 64),
+		strconv.FormatFloat(minY, 'f', -1, 64),
+		strconv.FormatFloat(maxX, 'f', -1, 64),
+		strconv.FormatFloat(maxY, 'f', -1, 64),
+	}, ",")
+}
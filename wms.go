@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Types of map sources.
+const (
+	sourceTypeXYZ = "xyz" // Tiles are requested with a URL template (default).
+	sourceTypeWMS = "wms" // Tiles are rendered by a WMS server with GetMap requests.
+)
+
+// WMSOptions are the GetMap parameters of a WMS source.
+type WMSOptions struct {
+	Layers      string            `json:"layers"`                // The comma separated layers to render.
+	Styles      string            `json:"styles,omitempty"`      // The comma separated styles of the layers (default: server default styles).
+	Format      string            `json:"format,omitempty"`      // The MIME type of the images (default: image/png).
+	Transparent bool              `json:"transparent,omitempty"` // Whether the images have a transparent background.
+	Version     string            `json:"version,omitempty"`     // The WMS version, 1.1.1 or 1.3.0 (default: 1.3.0).
+	Params      map[string]string `json:"params,omitempty"`      // Additional query parameters, e.g. a time dimension.
+}
+
+// wmsGetMapParams are the GetMap parameters that are set by the downloader and replace parameters of the service URL.
+var wmsGetMapParams = []string{"SERVICE", "REQUEST", "VERSION", "LAYERS", "STYLES", "FORMAT", "TRANSPARENT", "CRS", "SRS", "BBOX", "WIDTH", "HEIGHT"}
+
+// withDefaults returns the WMS options with the defaults filled in for fields that are not set.
+func (o WMSOptions) withDefaults() WMSOptions {
+	if o.Version == "" {
+		o.Version = "1.3.0"
+	}
+	if o.Format == "" {
+		o.Format = "image/png"
+	}
+	return o
+}
+
+// validateWMSOptions checks the GetMap parameters of a WMS source.
+func validateWMSOptions(o *WMSOptions) error {
+	if o == nil || strings.TrimSpace(o.Layers) == "" {
+		return errors.New("WMS source needs layers")
+	}
+	if o.Version != "" && o.Version != "1.1.1" && o.Version != "1.3.0" {
+		return fmt.Errorf("invalid WMS version %q (must be 1.1.1 or 1.3.0)", o.Version)
+	}
+	return nil
+}
+
+// wmsTemplate returns the URL template of the GetMap requests for the tiles of a WMS source.
+// The tiles are requested in EPSG:3857, so they match the tiles of XYZ sources.
+// Applying it to a URL template that it returned gives the same URL template.
+func wmsTemplate(serviceURL string, o WMSOptions, tileSize int) (string, error) {
+	u, err := url.Parse(serviceURL)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	for key := range query {
+		for _, param := range wmsGetMapParams {
+			if strings.EqualFold(key, param) {
+				query.Del(key)
+			}
+		}
+	}
+	for key, value := range o.Params {
+		query.Set(key, value)
+	}
+
+	crs := "CRS"
+	if o.Version == "1.1.1" {
+		crs = "SRS"
+	}
+	size := strconv.Itoa(tileSize)
+	query.Set("SERVICE", "WMS")
+	query.Set("REQUEST", "GetMap")
+	query.Set("VERSION", o.Version)
+	query.Set("LAYERS", o.Layers)
+	query.Set("STYLES", o.Styles)
+	query.Set("FORMAT", o.Format)
+	query.Set("TRANSPARENT", strings.ToUpper(strconv.FormatBool(o.Transparent)))
+	query.Set(crs, "EPSG:3857")
+	query.Set("WIDTH", size)
+	query.Set("HEIGHT", size)
+	// The placeholder is appended after encoding, because the encoding would escape the braces.
+	u.RawQuery = query.Encode() + "&BBOX={bbox-epsg-3857}"
+	return u.String(), nil
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// wmtsCapabilities is the part of a WMTS GetCapabilities document that is needed to import layers.
+type wmtsCapabilities struct {
+	ServiceProvider struct {
+		ProviderName string `xml:"ProviderName"`
+	} `xml:"ServiceProvider"`
+	Operations []struct {
+		Name string `xml:"name,attr"`
+		Gets []struct {
+			Href      string   `xml:"href,attr"`
+			Encodings []string `xml:"Constraint>AllowedValues>Value"`
+		} `xml:"DCP>HTTP>Get"`
+	} `xml:"OperationsMetadata>Operation"`
+	Layers         []wmtsLayer         `xml:"Contents>Layer"`
+	TileMatrixSets []wmtsTileMatrixSet `xml:"Contents>TileMatrixSet"`
+}
+
+// wmtsLayer is a layer of a WMTS capabilities document.
+type wmtsLayer struct {
+	Identifier string   `xml:"Identifier"`
+	Title      string   `xml:"Title"`
+	Formats    []string `xml:"Format"`
+	Styles     []struct {
+		Identifier string `xml:"Identifier"`
+		IsDefault  bool   `xml:"isDefault,attr"`
+	} `xml:"Style"`
+	Dimensions []struct {
+		Identifier string `xml:"Identifier"`
+		Default    string `xml:"Default"`
+	} `xml:"Dimension"`
+	TileMatrixSetLinks []struct {
+		TileMatrixSet string   `xml:"TileMatrixSet"`
+		Limits        []string `xml:"TileMatrixSetLimits>TileMatrixLimits>TileMatrix"`
+	} `xml:"TileMatrixSetLink"`
+	ResourceURLs []struct {
+		Format       string `xml:"format,attr"`
+		ResourceType string `xml:"resourceType,attr"`
+		Template     string `xml:"template,attr"`
+	} `xml:"ResourceURL"`
+}
+
+// wmtsTileMatrixSet is a tile matrix set of a WMTS capabilities document.
+type wmtsTileMatrixSet struct {
+	Identifier   string `xml:"Identifier"`
+	SupportedCRS string `xml:"SupportedCRS"`
+	TileMatrices []struct {
+		Identifier       string  `xml:"Identifier"`
+		ScaleDenominator float64 `xml:"ScaleDenominator"`
+		TopLeftCorner    string  `xml:"TopLeftCorner"`
+		TileWidth        int     `xml:"TileWidth"`
+		TileHeight       int     `xml:"TileHeight"`
+		MatrixWidth      int     `xml:"MatrixWidth"`
+		MatrixHeight     int     `xml:"MatrixHeight"`
+	} `xml:"TileMatrix"`
+}
+
+// wmtsImport is a layer of a WMTS capabilities document that can be imported as map source.
+type wmtsImport struct {
+	Name          string    `json:"name"`            // The suggested name of the map source.
+	Layer         string    `json:"layer"`           // The identifier of the layer.
+	TileMatrixSet string    `json:"tile_matrix_set"` // The identifier of the GoogleMapsCompatible tile matrix set.
+	Source        MapSource `json:"source"`          // The map source for the layer.
+}
+
+// googleMapsScaleDenominator is the scale denominator of zoom level 0 of the GoogleMapsCompatible tile matrix set.
+const googleMapsScaleDenominator = 559082264.0287178
+
+// wmtsZoomLevels returns the zoom levels of the tile matrices by identifier, and the common prefix of the identifiers
+// before the zoom level, if the tile matrix set is GoogleMapsCompatible.
+func wmtsZoomLevels(tms wmtsTileMatrixSet) (map[string]int, string, bool) {
+	crs := strings.ToUpper(tms.SupportedCRS)
+	if !strings.Contains(crs, "3857") && !strings.Contains(crs, "900913") || len(tms.TileMatrices) == 0 {
+		return nil, "", false
+	}
+	zooms := make(map[string]int)
+	prefix := ""
+	for i, matrix := range tms.TileMatrices {
+		level := math.Log2(googleMapsScaleDenominator / matrix.ScaleDenominator)
+		z := int(math.Round(level))
+		if math.Abs(level-float64(z)) > 0.01 || z < 0 || z > maxSourceZoom {
+			return nil, "", false
+		}
+		if matrix.TileWidth != 256 || matrix.TileHeight != 256 || matrix.MatrixWidth != 1<<z || matrix.MatrixHeight != 1<<z {
+			return nil, "", false
+		}
+		var x, y float64
+		if _, err := fmt.Sscan(matrix.TopLeftCorner, &x, &y); err != nil || math.Abs(x+earthCircumference/2) > 1 || math.Abs(y-earthCircumference/2) > 1 {
+			return nil, "", false
+		}
+		// The identifiers must be the zoom level with a common prefix, e.g. "5" or "EPSG:3857:5".
+		zoom := strconv.Itoa(z)
+		if !strings.HasSuffix(matrix.Identifier, zoom) {
+			return nil, "", false
+		}
+		matrixPrefix := strings.TrimSuffix(matrix.Identifier, zoom)
+		if i > 0 && matrixPrefix != prefix {
+			return nil, "", false
+		}
+		prefix = matrixPrefix
+		zooms[matrix.Identifier] = z
+	}
+	return zooms, prefix, true
+}
+
+// parseWMTSCapabilities returns the layers of a WMTS capabilities document that use a GoogleMapsCompatible tile matrix set.
+func parseWMTSCapabilities(data []byte) ([]wmtsImport, error) {
+	var caps wmtsCapabilities
+	if err := xml.Unmarshal(data, &caps); err != nil {
+		return nil, fmt.Errorf("invalid WMTS capabilities: %w", err)
+	}
+
+	tileMatrixSets := make(map[string]wmtsTileMatrixSet)
+	for _, tms := range caps.TileMatrixSets {
+		tileMatrixSets[tms.Identifier] = tms
+	}
+
+	var imports []wmtsImport
+	for _, layer := range caps.Layers {
+		for _, link := range layer.TileMatrixSetLinks {
+			zooms, prefix, ok := wmtsZoomLevels(tileMatrixSets[link.TileMatrixSet])
+			if !ok {
+				continue
+			}
+
+			// Restrict the zoom levels to the limits of the layer.
+			minZoom, maxZoom := maxSourceZoom, 0
+			matrices := link.Limits
+			if len(matrices) == 0 {
+				for identifier := range zooms {
+					matrices = append(matrices, identifier)
+				}
+			}
+			for _, identifier := range matrices {
+				if z, ok := zooms[identifier]; ok {
+					minZoom = min(minZoom, z)
+					maxZoom = max(maxZoom, z)
+				}
+			}
+			if minZoom > maxZoom {
+				continue
+			}
+
+			template, format := wmtsTileTemplate(caps, layer, link.TileMatrixSet, prefix)
+			if template == "" {
+				continue
+			}
+			source := MapSource{
+				URL:         template,
+				MinZoom:     minZoom,
+				MaxZoom:     &maxZoom,
+				Attribution: caps.ServiceProvider.ProviderName,
+				Format:      wmtsFormat(format),
+			}
+			if validateMapSource(source) != nil {
+				continue
+			}
+			name := layer.Title
+			if name == "" {
+				name = layer.Identifier
+			}
+			imports = append(imports, wmtsImport{
+				Name:          name,
+				Layer:         layer.Identifier,
+				TileMatrixSet: link.TileMatrixSet,
+				Source:        source,
+			})
+		}
+	}
+
+	// Layers with several GoogleMapsCompatible tile matrix sets get the tile matrix set in the name.
+	count := make(map[string]int)
+	for _, imp := range imports {
+		count[imp.Name]++
+	}
+	for i, imp := range imports {
+		if count[imp.Name] > 1 {
+			imports[i].Name = fmt.Sprintf("%s (%s)", imp.Name, imp.TileMatrixSet)
+		}
+	}
+	return imports, nil
+}
+
+// wmtsTileTemplate returns the URL template and format for the tiles of a layer in a tile matrix set.
+// RESTful resource URLs are preferred over KVP GetTile requests.
+func wmtsTileTemplate(caps wmtsCapabilities, layer wmtsLayer, tileMatrixSet, prefix string) (string, string) {
+	style := ""
+	for i, s := range layer.Styles {
+		if i == 0 || s.IsDefault {
+			style = s.Identifier
+		}
+	}
+
+	for _, resource := range layer.ResourceURLs {
+		if resource.ResourceType != "tile" || wmtsFormat(resource.Format) == "" {
+			continue
+		}
+		replacements := []string{
+			"{TileMatrixSet}", tileMatrixSet,
+			"{TileMatrix}", prefix + "{z}",
+			"{TileRow}", "{y}",
+			"{TileCol}", "{x}",
+			"{Style}", style,
+		}
+		for _, dimension := range layer.Dimensions {
+			replacements = append(replacements, "{"+dimension.Identifier+"}", dimension.Default)
+		}
+		return strings.NewReplacer(replacements...).Replace(resource.Template), resource.Format
+	}
+
+	// Fall back to KVP GetTile requests with the first supported format.
+	format := ""
+	for _, f := range layer.Formats {
+		if wmtsFormat(f) != "" {
+			format = f
+			break
+		}
+	}
+	if format == "" {
+		return "", ""
+	}
+	for _, op := range caps.Operations {
+		if op.Name != "GetTile" {
+			continue
+		}
+		for _, get := range op.Gets {
+			if len(get.Encodings) > 0 && !containsFold(get.Encodings, "KVP") {
+				continue
+			}
+			u, err := url.Parse(get.Href)
+			if err != nil {
+				continue
+			}
+			query := u.Query()
+			query.Set("SERVICE", "WMTS")
+			query.Set("REQUEST", "GetTile")
+			query.Set("VERSION", "1.0.0")
+			query.Set("LAYER", layer.Identifier)
+			query.Set("STYLE", style)
+			query.Set("FORMAT", format)
+			query.Set("TILEMATRIXSET", tileMatrixSet)
+			for _, dimension := range layer.Dimensions {
+				query.Set(dimension.Identifier, dimension.Default)
+			}
+			// The placeholders are appended after encoding, because the encoding would escape the braces.
+			u.RawQuery = query.Encode() + "&TILEMATRIX=" + url.QueryEscape(prefix) + "{z}&TILEROW={y}&TILECOL={x}"
+			return u.String(), format
+		}
+	}
+	return "", ""
+}
+
+// wmtsFormat returns the tile format of a MIME type, or an empty string if the format is not supported.
+func wmtsFormat(mimeType string) string {
+	switch strings.ToLower(strings.TrimSpace(strings.Split(mimeType, ";")[0])) {
+	case "image/png", "image/png8":
+		return "png"
+	case "image/jpeg", "image/jpg":
+		return "jpg"
+	case "image/webp":
+		return "webp"
+	case "image/gif":
+		return "gif"
+	case "application/vnd.mapbox-vector-tile", "application/x-protobuf":
+		return "pbf"
+	default:
+		return ""
+	}
+}
+
+// containsFold checks if a list contains a string, ignoring case.
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(strings.TrimSpace(item), s) {
+			return true
+		}
+	}
+	return false
+}
+
+// importWMTSLayers adds the layers with the given identifiers as map sources to the user sources file of the maps directory.
+// It returns the names of the added map sources.
+func importWMTSLayers(imports []wmtsImport, layers []string) ([]string, error) {
+	var names []string
+	for _, layer := range layers {
+		found := false
+		for _, imp := range imports {
+			if imp.Layer != layer && imp.Name != layer {
+				continue
+			}
+			found = true
+			if err := putUserSource(imp.Name, imp.Source, true); err != nil {
+				return names, err
+			}
+			names = append(names, imp.Name)
+		}
+		if !found {
+			return names, fmt.Errorf("%w: no GoogleMapsCompatible layer %q in the capabilities", errInvalidSource, layer)
+		}
+	}
+	return names, nil
+}
+
+// runImportWMTSCommand lists or imports the GoogleMapsCompatible layers of a WMTS capabilities document and returns the exit code.
+func runImportWMTSCommand(args []string) int {
+	fs := flag.NewFlagSet("import-wmts", flag.ExitOnError)
+	registerCacheDirFlag(fs)
+	registerSourcesFlag(fs)
+	registerHTTPClientFlags(fs)
+	capabilities := fs.String("capabilities", "", "File or URL of the WMTS GetCapabilities document")
+	layers := fs.String("layer", "", "Comma separated identifiers of the layers to import (default: list the layers)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s import-wmts [options]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *capabilities == "" {
+		log.Print("No capabilities document given")
+		return 2
+	}
+	if err := configureHTTPClient(); err != nil {
+		log.Print(err)
+		return 2
+	}
+	if err := loadMapSources(); err != nil {
+		log.Printf("Failed to load map sources: %v", err)
+		return 1
+	}
+
+	data, err := fetchDocument(*capabilities)
+	if err != nil {
+		log.Printf("Failed to read capabilities: %v", err)
+		return 1
+	}
+	imports, err := parseWMTSCapabilities(data)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	if len(imports) == 0 {
+		log.Print("No layers with a GoogleMapsCompatible tile matrix set found")
+		return 1
+	}
+
+	if *layers == "" {
+		sort.Slice(imports, func(i, j int) bool { return imports[i].Layer < imports[j].Layer })
+		for _, imp := range imports {
+			fmt.Printf("%s  %s  zoom %d-%d, %s  %q\n", imp.Layer, imp.TileMatrixSet, imp.Source.MinZoom, imp.Source.maxZoom(), imp.Source.Format, imp.Name)
+		}
+		return 0
+	}
+
+	if err := os.MkdirAll(*cacheDir, 0755); err != nil {
+		log.Printf("Failed to create maps directory: %v", err)
+		return 1
+	}
+	names, err := importWMTSLayers(imports, strings.Split(*layers, ","))
+	for _, name := range names {
+		fmt.Printf("Imported map source %q\n", name)
+	}
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	return 0
+}
+
+// apiImportWMTS lists the GoogleMapsCompatible layers of a WMTS capabilities document and imports the requested layers.
+func apiImportWMTS(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Capabilities string   `json:"capabilities"` // The URL of the capabilities document.
+		Layers       []string `json:"layers"`       // The identifiers of the layers to import.
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Capabilities == "" {
+		writeJSONError(w, http.StatusBadRequest, "Invalid import request")
+		return
+	}
+	if !strings.HasPrefix(req.Capabilities, "http://") && !strings.HasPrefix(req.Capabilities, "https://") {
+		writeJSONError(w, http.StatusBadRequest, "The capabilities must be an http or https URL")
+		return
+	}
+
+	data, err := fetchDocument(req.Capabilities)
+	if err != nil {
+		writeJSONError(w, http.StatusBadGateway, fmt.Sprintf("Could not read capabilities: %v", err))
+		return
+	}
+	imports, err := parseWMTSCapabilities(data)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	imported, err := importWMTSLayers(imports, req.Layers)
+	if err != nil {
+		writeSourceResult(w, 0, apiSource{}, err)
+		return
+	}
+	if imports == nil {
+		imports = []wmtsImport{}
+	}
+	if imported == nil {
+		imported = []string{}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"layers": imports, "imported": imported})
+}